@@ -0,0 +1,261 @@
+package httpenc
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultCacheMaxEntries = 100
+	defaultCacheMaxBytes   = 10 * 1024 * 1024
+)
+
+// cacheEntry is an encoded response stored in responseCache.
+type cacheEntry struct {
+	key        cacheKey
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+type cacheKey struct {
+	key string
+	enc EncodingType
+}
+
+// responseCache is an LRU cache of encoded responses.
+// It is bounded by both the number of entries and the total size of the bodies.
+type responseCache struct {
+	maxEntries int
+	maxBytes   int
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[cacheKey]*list.Element
+	size    int
+}
+
+func newResponseCache(maxEntries, maxBytes int) *responseCache {
+	return &responseCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		ll:         list.New(),
+		entries:    map[cacheKey]*list.Element{},
+	}
+}
+
+func (c *responseCache) get(key string, enc EncodingType) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey{key, enc}]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+
+	return elem.Value.(*cacheEntry), true
+}
+
+func (c *responseCache) add(entry *cacheEntry) {
+	if len(entry.body) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+
+	c.entries[entry.key] = c.ll.PushFront(entry)
+	c.size += len(entry.body)
+
+	for c.ll.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *responseCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.ll.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+// serveCached serves the encoded response from the cache,
+// or serves the response by the next handler and stores it in the cache.
+func (h *handler) serveCached(w http.ResponseWriter, r *http.Request, key string, encs []EncodingType) {
+	enc := encs[0]
+	if entry, ok := h.cache.get(key, enc); ok {
+		// The header set by the outer handlers for this request is kept.
+		header := w.Header()
+		for key, values := range entry.header {
+			if key == "Vary" {
+				for _, v := range values {
+					for _, field := range strings.Split(v, ",") {
+						if field = strings.TrimSpace(field); field != "" {
+							addVary(header, field)
+						}
+					}
+				}
+				continue
+			}
+			if _, ok := header[key]; !ok {
+				header[key] = append([]string(nil), values...)
+			}
+		}
+		w.WriteHeader(entry.statusCode)
+		w.Write(entry.body)
+		return
+	}
+
+	cw := newCacheResponseWriter(w, h.cache.maxBytes)
+	ew := newEncodeResonseWriter(cw, r, encs, h.options)
+
+	// The encoder is closed even if next panics, so that it is released.
+	var completed bool
+	defer func() {
+		if err := ew.Close(); err != nil || !completed {
+			return
+		}
+
+		// Only the successful and encoded responses are cached.
+		// The response encoded with the fallback encoding is not cached for enc.
+		if cw.overflow || cw.statusCode != http.StatusOK || !ew.encoding || ew.typ != enc {
+			return
+		}
+		// The response for a particular client is not shared with others.
+		if !cw.cacheable {
+			return
+		}
+		h.cache.add(&cacheEntry{
+			key:        cacheKey{key, enc},
+			statusCode: cw.statusCode,
+			header:     cw.header,
+			body:       cw.buf.Bytes(),
+		})
+	}()
+
+	h.next.ServeHTTP(ew, r)
+	completed = true
+}
+
+// cacheResponseWriter writes the response to the underlying http.ResponseWriter,
+// and records it to be stored in responseCache.
+type cacheResponseWriter struct {
+	w           http.ResponseWriter
+	maxBytes    int
+	statusCode  int
+	buf         bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+
+	// base is the header set before the next handler is called, such as by outer handlers.
+	base http.Header
+	// header is the header added or changed from base, which is stored in the cache.
+	header http.Header
+	// cacheable is false if the response must not be shared by clients.
+	cacheable bool
+}
+
+var (
+	_ http.ResponseWriter = (*cacheResponseWriter)(nil)
+	_ http.Flusher        = (*cacheResponseWriter)(nil)
+)
+
+func newCacheResponseWriter(w http.ResponseWriter, maxBytes int) *cacheResponseWriter {
+	return &cacheResponseWriter{
+		w:        w,
+		maxBytes: maxBytes,
+		base:     w.Header().Clone(),
+	}
+}
+
+func (w *cacheResponseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *cacheResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.overflow {
+		if w.buf.Len()+len(b) > w.maxBytes {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+
+	return w.w.Write(b)
+}
+
+func (w *cacheResponseWriter) Flush() {
+	flush(w.w)
+}
+
+func (w *cacheResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		// The underlying writer ignores and logs the superfluous call.
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	if isInformational(statusCode) {
+		// The informational response, such as 103 Early Hints, is not cached.
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
+
+	w.statusCode = statusCode
+	w.header, w.cacheable = headerDiff(w.base, w.Header())
+	// The cookie set by the outer handlers is not stored, and is set for each request by them.
+	if w.header.Get("Set-Cookie") != "" || hasCacheControl(w.Header(), "private") || hasCacheControl(w.Header(), "no-store") {
+		w.cacheable = false
+	}
+
+	w.w.WriteHeader(statusCode)
+}
+
+// headerDiff returns the header values of header added or changed from base.
+// It reports false if a header in base is removed, which can not be reproduced from the difference.
+func headerDiff(base, header http.Header) (http.Header, bool) {
+	diff := http.Header{}
+	for key, values := range header {
+		if !equalValues(base[key], values) {
+			diff[key] = append([]string(nil), values...)
+		}
+	}
+	for key := range base {
+		if _, ok := header[key]; !ok {
+			return diff, false
+		}
+	}
+	return diff, true
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,278 @@
+package httpenc
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newCacheTestHandler(calls *int, opts ...Option) http.Handler {
+	opts = append([]Option{CacheKeyFunc(func(r *http.Request) (string, bool) {
+		return r.URL.Path, r.URL.Path != "/nocache"
+	})}, opts...)
+
+	return Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("cached content of "+r.URL.Path, 10)))
+	}), opts...)
+}
+
+func doCacheRequest(t *testing.T, h http.Handler, path string, enc EncodingType) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept-Encoding", string(enc))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != string(enc) {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", got, enc)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type is not match: got %#v, want %#v", got, "text/plain")
+	}
+
+	body, err := decodeBody(rec.Body.Bytes(), enc)
+	if err != nil {
+		t.Fatalf("decodeBody(): %v", err)
+	}
+	if want := strings.Repeat("cached content of "+path, 10); string(body) != want {
+		t.Errorf("response body is not match: got %#v, want %#v", string(body), want)
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	var calls int
+	h := newCacheTestHandler(&calls)
+
+	tests := []struct {
+		path  string
+		enc   EncodingType
+		calls int
+	}{
+		{"/a", Gzip, 1},
+		{"/a", Gzip, 1},
+		{"/a", Brotli, 2},
+		{"/a", Brotli, 2},
+		{"/b", Gzip, 3},
+		{"/a", Gzip, 3},
+		{"/nocache", Gzip, 4},
+		{"/nocache", Gzip, 5},
+	}
+	for _, tt := range tests {
+		doCacheRequest(t, h, tt.path, tt.enc)
+		if calls != tt.calls {
+			t.Errorf("%s (%s): handler calls is not match: got %d, want %d", tt.path, tt.enc, calls, tt.calls)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	var calls int
+	h := newCacheTestHandler(&calls, CacheLimits(2, 1024))
+
+	tests := []struct {
+		path  string
+		calls int
+	}{
+		{"/a", 1},
+		{"/b", 2},
+		{"/a", 2},
+		// "/b" is evicted as the least recently used entry.
+		{"/c", 3},
+		{"/a", 3},
+		{"/b", 4},
+		{"/c", 5},
+	}
+	for _, tt := range tests {
+		doCacheRequest(t, h, tt.path, Gzip)
+		if calls != tt.calls {
+			t.Errorf("%s: handler calls is not match: got %d, want %d", tt.path, calls, tt.calls)
+		}
+	}
+}
+
+func TestCacheEvictionBySize(t *testing.T) {
+	var calls int
+	h := newCacheTestHandler(&calls, CacheLimits(100, 60))
+
+	doCacheRequest(t, h, "/a", Gzip)
+	doCacheRequest(t, h, "/b", Gzip)
+
+	if n := h.(*handler).cache.len(); n != 1 {
+		t.Errorf("number of cache entries is not match: got %d, want %d", n, 1)
+	}
+}
+
+func TestCacheEarlyHints(t *testing.T) {
+	var calls int
+	// httptest.ResponseRecorder does not support informational responses.
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("cached content of "+r.URL.Path, 10)))
+	}), CacheKeyFunc(func(r *http.Request) (string, bool) {
+		return r.URL.Path, true
+	})))
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): error: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Get: error: %v", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("io.ReadAll(resp.Body): error: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("invalid status: %s", resp.Status)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+			t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+		}
+		body, err = decodeBody(body, Gzip)
+		if err != nil {
+			t.Fatalf("decodeBody(): %v", err)
+		}
+		if want := strings.Repeat("cached content of /a", 10); string(body) != want {
+			t.Errorf("response body is not match: got %#v, want %#v", string(body), want)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("handler calls is not match: got %d, want %d", calls, 1)
+	}
+}
+
+func TestCacheNotOK(t *testing.T) {
+	var calls int
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "error", http.StatusInternalServerError)
+	}), CacheKeyFunc(func(r *http.Request) (string, bool) {
+		return r.URL.Path, true
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Errorf("handler calls is not match: got %d, want %d", calls, 2)
+	}
+}
+
+func TestCachePanic(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("cached content of "+r.URL.Path, 10)))
+		if r.URL.Path == "/panic" {
+			panic(http.ErrAbortHandler)
+		}
+	}), MaxConcurrentEncoders(1), CacheKeyFunc(func(r *http.Request) (string, bool) {
+		return r.URL.Path, true
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("recover() is not match: got %#v, want %#v", p, http.ErrAbortHandler)
+			}
+		}()
+		req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	// The encoder of the panicking request is released, so the next response is encoded.
+	doCacheRequest(t, h, "/a", Gzip)
+}
+
+func TestCacheOuterHeader(t *testing.T) {
+	var calls int
+	h := newCacheTestHandler(&calls)
+	// The outer middleware sets the header for each client.
+	outer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session="+r.URL.Query().Get("user"))
+		h.ServeHTTP(w, r)
+	})
+
+	for _, user := range []string{"alice", "bob"} {
+		req := httptest.NewRequest(http.MethodGet, "/a?user="+user, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+
+		outer.ServeHTTP(rec, req)
+
+		if got, want := rec.Header().Values("Set-Cookie"), []string{"session=" + user}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Set-Cookie is not match: got %#v, want %#v", user, got, want)
+		}
+		if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+			t.Errorf("%s: Content-Encoding is not match: got %#v, want %#v", user, got, "gzip")
+		}
+		if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+			t.Errorf("%s: Content-Type is not match: got %#v, want %#v", user, got, "text/plain")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("handler calls is not match: got %d, want %d", calls, 1)
+	}
+}
+
+var cacheNotCacheableTests = map[string]struct {
+	header string
+	value  string
+	calls  int
+}{
+	"set cookie":    {header: "Set-Cookie", value: "session=alice", calls: 2},
+	"private":       {header: "Cache-Control", value: "private, max-age=60", calls: 2},
+	"private field": {header: "Cache-Control", value: `private="Set-Cookie"`, calls: 2},
+	"no store":      {header: "Cache-Control", value: "no-store", calls: 2},
+	"public":        {header: "Cache-Control", value: "public, max-age=60", calls: 1},
+}
+
+func TestCacheNotCacheable(t *testing.T) {
+	for name, tt := range cacheNotCacheableTests {
+		t.Run(name, func(t *testing.T) {
+			var calls int
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set(tt.header, tt.value)
+				w.Write([]byte(strings.Repeat("cached content of "+r.URL.Path, 10)))
+			}), CacheKeyFunc(func(r *http.Request) (string, bool) {
+				return r.URL.Path, true
+			}))
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			if calls != tt.calls {
+				t.Errorf("handler calls is not match: got %d, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
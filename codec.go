@@ -0,0 +1,74 @@
+package httpenc
+
+import (
+	"bytes"
+	"io"
+)
+
+// NewEncoder returns a writer that encodes the data written to it with enc
+// at the compression level, and writes the encoded data to w.
+// The level must be valid for enc, as GzipLevel, DeflateLevel and BrotliLevel require.
+// The caller must close the writer to flush the remaining data.
+func NewEncoder(w io.Writer, enc EncodingType, level int) (io.WriteCloser, error) {
+	return newLevelEncoder(w, enc, level, 0)
+}
+
+// newLevelEncoder returns a writer that encodes with enc at the compression level.
+func newLevelEncoder(w io.Writer, enc EncodingType, level int, sizeHint int64) (io.WriteCloser, error) {
+	if err := validateLevel(enc, level); err != nil {
+		return nil, err
+	}
+	options := &handlerOptions{
+		gzipLevel:    level,
+		deflateLevel: level,
+		brotliLevel:  level,
+	}
+
+	return newEncoder(w, enc, sizeHint, "", options)
+}
+
+// Encode encodes data with enc at the compression level.
+// The level must be valid for enc, as GzipLevel, DeflateLevel and BrotliLevel require.
+func Encode(enc EncodingType, level int, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newLevelEncoder(&buf, enc, level, int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, &EncodeError{Encoding: enc, Op: "encode", Err: err}
+	}
+	if err := w.Close(); err != nil {
+		return nil, &EncodeError{Encoding: enc, Op: "encode", Err: err}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeReader returns a reader that decodes the content read from r encoded with enc.
+// The deflate content is decoded whether it has the zlib wrapper or not.
+// The caller must close the returned reader, which does not close r.
+func DecodeReader(enc EncodingType, r io.Reader) (io.ReadCloser, error) {
+	dec, err := newDecoder(r, enc, nil)
+	if err != nil {
+		return nil, &EncodeError{Encoding: enc, Op: "decode", Err: err}
+	}
+	return dec, nil
+}
+
+// Decode decodes data encoded with enc.
+func Decode(enc EncodingType, data []byte) ([]byte, error) {
+	r, err := newDecoder(bytes.NewReader(data), enc, nil)
+	if err != nil {
+		return nil, &EncodeError{Encoding: enc, Op: "decode", Err: err}
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, &EncodeError{Encoding: enc, Op: "decode", Err: err}
+	}
+
+	return b, nil
+}
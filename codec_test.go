@@ -0,0 +1,187 @@
+package httpenc
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+var codecTests = map[string]struct {
+	enc   EncodingType
+	level int
+}{
+	"gzip":           {enc: Gzip, level: gzip.DefaultCompression},
+	"gzip (best)":    {enc: Gzip, level: gzip.BestCompression},
+	"deflate":        {enc: Deflate, level: zlib.DefaultCompression},
+	"deflate (fast)": {enc: Deflate, level: zlib.BestSpeed},
+	"brotli":         {enc: Brotli, level: brotli.DefaultCompression},
+	"brotli (best)":  {enc: Brotli, level: brotli.BestCompression},
+}
+
+func TestEncodeDecode(t *testing.T) {
+	data := benchmarkText(64 * 1024)
+
+	for name, tt := range codecTests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := Encode(tt.enc, tt.level, data)
+			if err != nil {
+				t.Fatalf("Encode(): error: %v", err)
+			}
+			if len(encoded) >= len(data) {
+				t.Errorf("Encode(): data is not compressed: %d bytes", len(encoded))
+			}
+
+			// decode by the standard decoders.
+			got, err := decodeBody(encoded, tt.enc)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decodeBody(): data is not match")
+			}
+
+			got, err = Decode(tt.enc, encoded)
+			if err != nil {
+				t.Fatalf("Decode(): error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Decode(): data is not match")
+			}
+		})
+	}
+}
+
+func TestNewEncoder(t *testing.T) {
+	data := benchmarkText(64 * 1024)
+
+	for name, tt := range codecTests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewEncoder(&buf, tt.enc, tt.level)
+			if err != nil {
+				t.Fatalf("NewEncoder(): error: %v", err)
+			}
+			// write in small chunks.
+			for b := data; len(b) > 0; {
+				n := 1000
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err := w.Write(b[:n]); err != nil {
+					t.Fatalf("Write(): error: %v", err)
+				}
+				b = b[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close(): error: %v", err)
+			}
+
+			got, err := decodeBody(buf.Bytes(), tt.enc)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decodeBody(): data is not match")
+			}
+		})
+	}
+}
+
+func TestNewEncoderInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := NewEncoder(&buf, Gzip, 100); err == nil {
+		t.Error("NewEncoder(): must fail with an invalid level")
+	}
+	if _, err := NewEncoder(&buf, "unknown", 0); err == nil {
+		t.Error("NewEncoder(): must fail with an unsupported encoding")
+	}
+}
+
+func TestEncodeInvalidLevel(t *testing.T) {
+	if _, err := Encode(Brotli, 100, []byte("data")); err == nil {
+		t.Error("Encode(): must fail with an invalid level")
+	}
+	if _, err := Encode("unknown", 0, []byte("data")); err == nil {
+		t.Error("Encode(): must fail with an unsupported encoding")
+	}
+}
+
+func TestDecodeReader(t *testing.T) {
+	data := benchmarkText(64 * 1024)
+
+	for name, tt := range codecTests {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := Encode(tt.enc, tt.level, data)
+			if err != nil {
+				t.Fatalf("Encode(): error: %v", err)
+			}
+
+			r, err := DecodeReader(tt.enc, bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("DecodeReader(): error: %v", err)
+			}
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("io.ReadAll(): error: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("DecodeReader(): data is not match")
+			}
+		})
+	}
+}
+
+func TestDecodeReaderRawDeflate(t *testing.T) {
+	data := benchmarkText(64 * 1024)
+
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatalf("flate.NewWriter(): error: %v", err)
+	}
+	fw.Write(data)
+	fw.Close()
+
+	r, err := DecodeReader(Deflate, &buf)
+	if err != nil {
+		t.Fatalf("DecodeReader(): error: %v", err)
+	}
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("io.ReadAll(): error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("DecodeReader(): data is not match")
+	}
+}
+
+func TestDecodeReaderUnsupported(t *testing.T) {
+	_, err := DecodeReader("unknown", bytes.NewReader(nil))
+
+	var encErr *EncodeError
+	if !errors.As(err, &encErr) {
+		t.Fatalf("errors.As(): error is not *EncodeError: %v", err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	_, err := Decode(Gzip, []byte("this is not a gzip content"))
+
+	var encErr *EncodeError
+	if !errors.As(err, &encErr) {
+		t.Fatalf("errors.As(): error is not *EncodeError: %v", err)
+	}
+	if encErr.Encoding != Gzip || encErr.Op != "decode" {
+		t.Errorf("EncodeError is not match: got %+v", encErr)
+	}
+}
@@ -0,0 +1,188 @@
+package httpenc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// precompressionExts is the extensions of precompression files looked up by FileHandler.
+var precompressionExts = map[EncodingType]string{
+	Brotli: ".br",
+	Gzip:   ".gz",
+}
+
+// FileHandler returns a handler that serves HTTP requests with the contents of
+// the file system rooted at root, and encodes the response contents.
+//
+// If the client accepts the encoding of a precompression file next to the requested file,
+// such as "index.html.gz" for "index.html", the precompression file is served instead,
+// unless DisablePrecompression is set.
+func FileHandler(root string, opts ...Option) http.Handler {
+	fs := http.Dir(root)
+	return &fileHandler{
+		fs: fs,
+		h:  newHandler(http.FileServer(fs), true, opts),
+	}
+}
+
+// fileHandler is the handler returned by FileHandler.
+type fileHandler struct {
+	fs http.FileSystem
+	h  *handler
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The precompression file is not looked up if an outer handler encodes the response.
+	if !h.h.options.disablePrecompression && !isHandled(r) {
+		if req, ok := precompressionRequest(h.fs, r); ok {
+			r = req
+		}
+	}
+	h.h.ServeHTTP(w, r)
+}
+
+var _ EncodingSwitch = (*fileHandler)(nil)
+
+// SetEncodingEnabled enables or disables the encoding enc of responses encoded on the fly.
+func (h *fileHandler) SetEncodingEnabled(enc EncodingType, enabled bool) {
+	h.h.SetEncodingEnabled(enc, enabled)
+}
+
+// precompressionRequest returns a request for the precompression file of the file requested by r,
+// if it exists and the client accepts its encoding.
+func precompressionRequest(fs http.FileSystem, r *http.Request) (*http.Request, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, false
+	}
+
+	name := r.URL.Path
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	if strings.HasSuffix(name, "/") {
+		return nil, false
+	}
+	name = path.Clean(name)
+	if _, ok := precompressionEncodeMap[path.Ext(name)]; ok {
+		return nil, false
+	}
+
+	for _, enc := range negotiateEncodings(parseAcceptedEncoding(r), []EncodingType{Brotli, Gzip}) {
+		preName := name + precompressionExts[enc]
+		if !isRegularFile(fs, preName) {
+			continue
+		}
+
+		req := r.Clone(r.Context())
+		req.URL.Path = preName
+		req.URL.RawPath = ""
+		return req, true
+	}
+
+	return nil, false
+}
+
+func isRegularFile(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode().IsRegular()
+}
+
+// A WriteFS is a file system that files can be written to.
+type WriteFS interface {
+	// WriteFile writes data to the file named name, creating it if necessary.
+	// The name is a slash-separated path as fs.FS uses.
+	WriteFile(name string, data []byte) error
+}
+
+// A WriteDir implements WriteFS using the native file system restricted to a specific directory tree,
+// as http.Dir does for reading.
+type WriteDir string
+
+// WriteFile writes data to the file named name in the directory d,
+// creating the parent directories if necessary.
+func (d WriteDir) WriteFile(name string, data []byte) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrInvalid}
+	}
+	fullName := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fullName), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(fullName, data, 0o644)
+}
+
+// PrecompressDir walks the file system fsys, and writes the precompression files of the files,
+// such as "index.html.gz" and "index.html.br" for "index.html", to dst with encs at the levels.
+// Only gzip and brotli are supported for encs. If levels has no level of an encoding,
+// the default level is used. The files of already compressed types, such as images
+// and archives, and the precompression files are skipped. A precompression file is not
+// written if it is not smaller than the original file.
+// The precompression files can be served by FileHandler.
+func PrecompressDir(fsys fs.FS, dst WriteFS, encs []EncodingType, levels map[EncodingType]int) error {
+	defaultLevels := map[EncodingType]int{
+		Gzip:   gzip.DefaultCompression,
+		Brotli: brotli.DefaultCompression,
+	}
+	for _, enc := range encs {
+		if _, ok := precompressionExts[enc]; !ok {
+			return fmt.Errorf("httpenc: unsupported encoding of precompression: %s", enc)
+		}
+		if level, ok := levels[enc]; ok {
+			if err := validateLevel(enc, level); err != nil {
+				return err
+			}
+		}
+	}
+
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(name))
+		if _, ok := precompressionEncodeMap[ext]; ok || compressedExts[ext] {
+			return nil
+		}
+
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		for _, enc := range encs {
+			level, ok := levels[enc]
+			if !ok {
+				level = defaultLevels[enc]
+			}
+			b, err := Encode(enc, level, data)
+			if err != nil {
+				return err
+			}
+			if len(b) >= len(data) {
+				continue
+			}
+			if err := dst.WriteFile(name+precompressionExts[enc], b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
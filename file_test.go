@@ -0,0 +1,208 @@
+package httpenc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+var fileHandlerTests = map[string]struct {
+	options         []Option
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	contentType     string
+	body            string
+}{
+	"precompression": {
+		path:            "/app.js",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "precompressed",
+	},
+	"not accepted": {
+		path:            "/app.js",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "plain",
+	},
+	"compression": {
+		path:            "/style.css",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentType:     "text/css; charset=utf-8",
+		body:            "body {}",
+	},
+	"precompression disabled": {
+		options:         []Option{DisablePrecompression()},
+		path:            "/app.js",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "plain",
+	},
+	"precompression requested": {
+		path:            "/app.js.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "precompressed",
+	},
+}
+
+func TestFileHandler(t *testing.T) {
+	root := t.TempDir()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("precompressed"))
+	gw.Close()
+
+	files := map[string][]byte{
+		"app.js":    []byte("plain"),
+		"app.js.gz": buf.Bytes(),
+		"style.css": []byte("body {}"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatalf("os.WriteFile(): error: %v", err)
+		}
+	}
+
+	for name, tt := range fileHandlerTests {
+		t.Run(name, func(t *testing.T) {
+			h := FileHandler(root, tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("invalid status: %d", rec.Code)
+			}
+			if typ := rec.Header().Get("Content-Type"); typ != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, tt.contentType)
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+func TestFileHandlerSetEncodingEnabled(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "style.css"), []byte("body {}"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(): error: %v", err)
+	}
+
+	h := FileHandler(root)
+	s, ok := h.(EncodingSwitch)
+	if !ok {
+		t.Fatal("handler does not implement EncodingSwitch")
+	}
+
+	for _, tt := range []struct {
+		enabled         bool
+		contentEncoding string
+	}{
+		{false, "gzip"},
+		{true, "br"},
+	} {
+		s.SetEncodingEnabled(Brotli, tt.enabled)
+
+		req := httptest.NewRequest(http.MethodGet, "/style.css", nil)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+			t.Errorf("brotli enabled %v: Content-Encoding is not match: got %#v, want %#v", tt.enabled, enc, tt.contentEncoding)
+		}
+	}
+}
+
+func TestPrecompressDir(t *testing.T) {
+	root := t.TempDir()
+
+	files := map[string][]byte{
+		"index.html":    benchmarkText(4096),
+		"css/style.css": benchmarkText(2048),
+		"image.png":     benchmarkText(2048),
+		"app.js.gz":     benchmarkText(2048),
+		"tiny.txt":      []byte("a"),
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll(): error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), data, 0o644); err != nil {
+			t.Fatalf("os.WriteFile(): error: %v", err)
+		}
+	}
+
+	err := PrecompressDir(os.DirFS(root), WriteDir(root), []EncodingType{Gzip, Brotli}, map[EncodingType]int{
+		Brotli: brotli.BestCompression,
+	})
+	if err != nil {
+		t.Fatalf("PrecompressDir(): error: %v", err)
+	}
+
+	for _, name := range []string{"index.html", "css/style.css"} {
+		for enc, ext := range map[EncodingType]string{Gzip: ".gz", Brotli: ".br"} {
+			b, err := os.ReadFile(filepath.Join(root, name+ext))
+			if err != nil {
+				t.Fatalf("os.ReadFile(): error: %v", err)
+			}
+			body, err := decodeBody(b, enc)
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, files[name]) {
+				t.Errorf("%s%s is not match: got %d bytes, want %d bytes", name, ext, len(body), len(files[name]))
+			}
+		}
+	}
+
+	// Already compressed files, precompression files, and files not to be smaller are skipped.
+	for _, name := range []string{"image.png.gz", "image.png.br", "app.js.gz.gz", "app.js.gz.br", "tiny.txt.gz", "tiny.txt.br"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s must not exist: %v", name, err)
+		}
+	}
+}
+
+func TestPrecompressDirUnsupported(t *testing.T) {
+	root := t.TempDir()
+
+	if err := PrecompressDir(os.DirFS(root), WriteDir(root), []EncodingType{Deflate}, nil); err == nil {
+		t.Error("PrecompressDir(): must fail with an unsupported encoding")
+	}
+}
@@ -2,14 +2,26 @@
 package httpenc
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime"
+	"net"
 	"net/http"
 	"path"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/andybalholm/brotli"
 	"github.com/kechako/httpqv"
@@ -31,295 +43,1669 @@ func (typ EncodingType) IsValid() bool {
 	return false
 }
 
-var precompressionEncodeMap = map[string]EncodingType{
-	".gz": Gzip,
-	".br": Brotli,
+type precompression struct {
+	encoding EncodingType
+	// ext is the extension of the original content.
+	// If it is empty, the extension of the name without the precompression extension is used.
+	ext string
 }
 
+var precompressionEncodeMap = map[string]precompression{
+	".gz":   {encoding: Gzip},
+	".br":   {encoding: Brotli},
+	".svgz": {encoding: Gzip, ext: ".svg"},
+}
+
+// EncodeError is the error returned when encoding or decoding a response content fails.
+type EncodeError struct {
+	Encoding EncodingType
+	Op       string
+	Err      error
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("httpenc: failed to %s %s: %v", e.Op, e.Encoding, e.Err)
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotAcceptable is the error passed to the error handler set by OnError,
+// when the client does not accept the content type of the precompression content.
+var ErrNotAcceptable = errors.New("httpenc: not acceptable")
+
 const (
 	contentTypeHeader     = "Content-Type"
 	contentEncodingHeader = "Content-Encoding"
+	warningHeader         = "Warning"
 )
 
+// transformationWarning is the Warning header value added by TransformationWarning.
+const transformationWarning = `214 - "Transformation Applied"`
+
 // Handler returns a handler that encodes a response content.
+//
+// The Content-Length header of an encoded response is removed, since the length of
+// the encoded content is not known until it is written. The same applies to HEAD requests,
+// so that the headers of a HEAD response match those of the GET response.
+// The Vary header of a response lists Accept-Encoding, unless DisableVary is set.
+//
+// The precompression content is decoded if the client does not accept its content encoding.
+// If it can not be decoded, such as truncated by a failed build, the response is aborted
+// by panicking with http.ErrAbortHandler, rather than sent as if it were complete.
+//
+// Flushing the response writer passed to next flushes the encoder as well, so that a streaming
+// response, such as multipart/x-mixed-replace, is delivered part by part if next flushes
+// after each part. A streaming response is not delivered promptly without flushing,
+// so it should be excluded by SkipContentTypes if next does not flush.
+//
+// Handler can wrap http.TimeoutHandler, and then the timeout message is encoded as well.
+// Handler can also be wrapped by http.TimeoutHandler, and then the encoded content is
+// buffered by it and the timeout message is sent without encoding.
+//
+// The response writer passed to next is not safe for concurrent use, as any http.ResponseWriter,
+// unless ConcurrentSafe is set.
+//
+// It panics if next is nil.
 func Handler(next http.Handler, opts ...Option) http.Handler {
+	return newHandler(next, true, opts)
+}
+
+// DecodeHandler returns a handler that only serves precompression content.
+// The precompression content is decoded if the client does not accept its content encoding,
+// but a response content is never encoded on the fly.
+// If the precompression content can not be decoded, such as truncated by a failed build,
+// the response is aborted by panicking with http.ErrAbortHandler.
+// It panics if next is nil.
+func DecodeHandler(next http.Handler, opts ...Option) http.Handler {
+	return newHandler(next, false, opts)
+}
+
+type contextKey int
+
+const (
+	// handledKey is the context key that marks a request handled by a handler of this package,
+	// so that nested handlers do not encode nor decode a response twice.
+	// A handler returned by Handler marks every request, but one returned by DecodeHandler
+	// marks only a request for precompression content, since it does nothing for others.
+	handledKey contextKey = iota
+	// forcedEncodingKey is the context key of the encoding set by WithForcedEncoding.
+	forcedEncodingKey
+)
+
+// WithForcedEncoding returns a copy of ctx that makes the handler encode a response
+// to the request with ctx with enc, instead of the encoding the client prefers.
+// enc is used only if the client accepts it and the handler has it available.
+func WithForcedEncoding(ctx context.Context, enc EncodingType) context.Context {
+	return context.WithValue(ctx, forcedEncodingKey, enc)
+}
+
+// preferForcedEncoding moves the encoding set by WithForcedEncoding to the front of encs, if any.
+func preferForcedEncoding(ctx context.Context, encs []EncodingType) []EncodingType {
+	forced, ok := ctx.Value(forcedEncodingKey).(EncodingType)
+	if !ok {
+		return encs
+	}
+	for i, enc := range encs {
+		if strings.EqualFold(string(enc), string(forced)) {
+			return moveToFront(encs, i)
+		}
+	}
+	return encs
+}
+
+// moveToFront returns a copy of encs with encs[i] moved to the front.
+func moveToFront(encs []EncodingType, i int) []EncodingType {
+	preferred := make([]EncodingType, 0, len(encs))
+	preferred = append(preferred, encs[i])
+	preferred = append(preferred, encs[:i]...)
+	return append(preferred, encs[i+1:]...)
+}
+
+type handler struct {
+	next    http.Handler
+	options *handlerOptions
+	encode  bool
+	cache   *responseCache
+
+	// encodings holds the available encodings that are enabled, as []EncodingType.
+	encodings atomic.Value
+	mu        sync.Mutex
+	disabled  map[EncodingType]bool
+}
+
+// An EncodingSwitch enables or disables encodings at runtime.
+// The handlers returned by Handler and FileHandler implement it, for example,
+// to disable brotli globally without a redeploy:
+//
+//	h.(httpenc.EncodingSwitch).SetEncodingEnabled(httpenc.Brotli, false)
+type EncodingSwitch interface {
+	// SetEncodingEnabled enables or disables the encoding enc of responses encoded on the fly.
+	// Precompression content is not affected. It is safe for concurrent use while serving.
+	SetEncodingEnabled(enc EncodingType, enabled bool)
+}
+
+var _ EncodingSwitch = (*handler)(nil)
+
+// SetEncodingEnabled enables or disables the encoding enc of responses encoded on the fly.
+func (h *handler) SetEncodingEnabled(enc EncodingType, enabled bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if enabled {
+		delete(h.disabled, enc)
+	} else {
+		h.disabled[enc] = true
+	}
+
+	encs := make([]EncodingType, 0, len(h.options.encodings))
+	for _, typ := range h.options.encodings {
+		if !h.disabled[typ] {
+			encs = append(encs, typ)
+		}
+	}
+	h.encodings.Store(encs)
+}
+
+// enabledEncodings returns the available encodings that are enabled, in order of preference.
+func (h *handler) enabledEncodings() []EncodingType {
+	return h.encodings.Load().([]EncodingType)
+}
+
+func newHandler(next http.Handler, encode bool, opts []Option) *handler {
+	if next == nil {
+		panic(errors.New("httpenc: nil handler"))
+	}
+
 	options := &handlerOptions{
 		gzipLevel:    gzip.DefaultCompression,
 		deflateLevel: zlib.DefaultCompression,
 		brotliLevel:  brotli.DefaultCompression,
+		encodings:    append([]EncodingType(nil), supportedEncodings...),
+
+		cacheMaxEntries: defaultCacheMaxEntries,
+		cacheMaxBytes:   defaultCacheMaxBytes,
 	}
 	for _, opt := range opts {
 		opt.apply(options)
 	}
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		// supported headers
-		case http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions, http.MethodPatch:
-		default:
-			next.ServeHTTP(w, r)
-			return
-		}
+	h := &handler{
+		next:     next,
+		options:  options,
+		encode:   encode,
+		disabled: map[EncodingType]bool{},
+	}
+	if options.cacheKeyFunc != nil {
+		h.cache = newResponseCache(options.cacheMaxEntries, options.cacheMaxBytes)
+	}
+	h.encodings.Store(options.encodings)
 
-		name := path.Base(r.URL.Path)
-		ext := path.Ext(name)
+	return h
+}
 
-		values := parseAcceptedEncoding(r)
-		accepted := map[string]*httpqv.Value{}
-		for _, v := range values {
-			accepted[v.Value] = v
-		}
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	// supported headers
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete, http.MethodOptions, http.MethodPatch:
+	default:
+		h.options.skip(ReasonMethod, r)
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if isHandled(r) {
+		// The request is already handled by an outer handler.
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	// The mode is updated by the response writers when the header is written.
+	h.options.setDebugMode(w.Header(), debugModePassthrough)
+
+	values := parseAcceptedEncoding(r)
+	if h.options.assumeGzip && r.Header["Accept-Encoding"] == nil {
+		values = []*httpqv.Value{{Value: string(Gzip), Priority: 1}}
+	}
+	if h.options.assumeBrotliUA != nil && !listedEncoding(values, Brotli) && h.options.assumeBrotliUA(r.UserAgent()) {
+		values = append([]*httpqv.Value{{Value: string(Brotli), Priority: 1}}, values...)
+	}
+	skipReason := h.options.skipRequest(r)
+	if skipReason != "" {
+		// The client is treated as if it accepts no encodings.
+		values = nil
+	}
 
-		newRW := w
-		if enc, ok := precompressionEncodeMap[ext]; ok {
-			header := http.Header{}
+	enc, contentType, req, precompressed := h.lookupPrecompression(r)
+	if precompressed || h.encode {
+		ctx := context.WithValue(r.Context(), handledKey, true)
+		r = r.WithContext(ctx)
+		if req != nil {
+			req = req.WithContext(ctx)
+		}
+	}
+	if (precompressed || h.encode) && !h.options.disableVary {
+		// The response depends on the Accept-Encoding header, whether it is encoded or not.
+		addVary(w.Header(), "Accept-Encoding")
+	}
 
-			origExt := path.Ext(name[:len(name)-len(ext)])
-			header.Set(contentTypeHeader, contentTypeByExtension(origExt))
+	newRW := w
+	if precompressed {
+		origPath := r.URL.Path
+		r = req
 
-			if _, ok := accepted[string(enc)]; ok {
-				// It jsut write the precompression content.
-				// And set Content-Encoding header for it.
-				header.Set(contentEncodingHeader, string(enc))
-				hw := newHeaderResponseWriter(w, header)
-				defer hw.Close()
+		// header is created for each request, since the response writers modify
+		// the response headers with it.
+		header := http.Header{}
 
-				newRW = hw
+		if h.options.validatePrecompressAccept && !h.options.disableVary {
+			// The response is 406 Not Acceptable or not, depending on the Accept header.
+			addVary(w.Header(), "Accept")
+		}
+		if h.options.validatePrecompressAccept && !acceptsContentType(r, contentType) {
+			if h.options.onError != nil {
+				h.options.onError(w, r, ErrNotAcceptable)
 			} else {
-				// Precompression content is requested, but the client does not accept the content encoding.
-				// Therefore, it decode the precompression content.
-				dw := newDecodeResonseWriter(w, enc, header)
-				defer dw.Close()
+				http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			}
+			return
+		}
+		header.Set(contentTypeHeader, contentType)
+
+		if len(negotiateEncodings(values, []EncodingType{enc})) > 0 {
+			// It jsut write the precompression content.
+			// And set Content-Encoding header for it.
+			// A Range request is served against the precompression content as is,
+			// so a partial response also has the Content-Encoding header.
+			header.Set(contentEncodingHeader, string(h.options.outputEncoding(enc)))
+			h.options.setDebugMode(header, debugModePrecompressed)
+			hw := newHeaderResponseWriter(w, header)
+			defer hw.Close()
+
+			newRW = hw
+		} else if f, fi, ok := h.openUncompressedSibling(origPath); ok {
+			// The uncompressed sibling of the precompression content is served as is,
+			// which is cheaper than decoding.
+			defer f.Close()
+
+			dst := w
+			if h.encode && h.options.transcodePrecompression {
+				if encs := h.negotiate(r, values, skipReason); len(encs) > 0 {
+					ew := newEncodeResonseWriter(w, r, encs, h.options)
+					defer ew.Close()
 
-				newRW = dw
+					dst = ew
+				}
 			}
+			dst.Header().Set(contentTypeHeader, contentType)
+			http.ServeContent(dst, r, fi.Name(), fi.ModTime(), f)
+			return
 		} else {
-			for _, value := range values {
-				enc := EncodingType(value.Value)
-				if enc.IsValid() {
-					ew := newEncodeResonseWriter(w, enc, options)
+			// Precompression content is requested, but the client does not accept the content encoding.
+			// Therefore, it decode the precompression content.
+			// A range of the precompression content can not be decoded,
+			// so the whole content is requested.
+			r.Header = r.Header.Clone()
+			r.Header.Del("Range")
+			r.Header.Del("If-Range")
+
+			dst := w
+			if h.encode && h.options.transcodePrecompression {
+				// And encode the decoded content again with the encoding the client accepts.
+				if encs := h.negotiate(r, values, skipReason); len(encs) > 0 {
+					ew := newEncodeResonseWriter(w, r, encs, h.options)
 					defer ew.Close()
 
-					newRW = ew
-					break
+					dst = ew
 				}
 			}
-		}
+			if h.options.transformationWarning {
+				addTransformationWarning(header)
+			}
+			h.options.setDebugMode(header, debugModeDecoded)
+			dw := newDecodeResonseWriter(dst, enc, header, h.options)
+			defer func() {
+				if p := recover(); p != nil {
+					// The panic of next is not replaced by the error of the content it left partially written.
+					dw.Close()
+					panic(p)
+				}
+				if err := dw.Close(); err != nil {
+					// The precompression content is broken, such as truncated by a failed build,
+					// so the response is aborted rather than sent as if it were complete.
+					panic(http.ErrAbortHandler)
+				}
+			}()
 
-		next.ServeHTTP(newRW, r)
-	})
-}
+			newRW = dw
+		}
+	} else if h.encode && h.options.skipFetchDests[strings.ToLower(r.Header.Get("Sec-Fetch-Dest"))] {
+		h.options.skip(ReasonFetchDest, r)
+	} else if h.encode {
+		var encs []EncodingType
+		if enc, ok := h.parentEncoding(w.Header()); ok {
+			// A parent handler has chosen the encoding without writing the content,
+			// and expects the content to be encoded with it, instead of negotiating.
+			w.Header().Del(contentEncodingHeader)
+			encs = []EncodingType{enc}
+		} else {
+			encs = h.negotiate(r, values, skipReason)
+		}
+		if len(encs) > 0 {
+			if h.cache != nil && r.Method == http.MethodGet {
+				if key, ok := h.options.cacheKeyFunc(r); ok {
+					h.serveCached(w, r, key, encs)
+					return
+				}
+			}
 
-func parseAcceptedEncoding(r *http.Request) []*httpqv.Value {
-	s := r.Header.Get("Accept-Encoding")
-	if s == "" {
-		return nil
-	}
+			ew := newEncodeResonseWriter(w, r, encs, h.options)
+			defer ew.Close()
 
-	values, err := httpqv.Parse(s)
-	if err != nil {
-		return nil
+			newRW = ew
+		} else if skipReason != "" {
+			h.options.skip(skipReason, r)
+		} else {
+			h.options.skip(ReasonNotAccepted, r)
+		}
 	}
 
-	httpqv.Sort(values)
-
-	return values
+	h.next.ServeHTTP(newRW, r)
 }
 
-func contentTypeByExtension(ext string) string {
-	typ := mime.TypeByExtension(ext)
-	if typ == "" {
-		typ = "application/octet-stream"
+// parentEncoding returns the available encoding set to the Content-Encoding header of header
+// by a parent handler. It reports false if the header is not set, or the encoding is not available.
+func (h *handler) parentEncoding(header http.Header) (EncodingType, bool) {
+	v := strings.TrimSpace(header.Get(contentEncodingHeader))
+	if v == "" {
+		return "", false
 	}
-	return typ
+	for _, typ := range h.enabledEncodings() {
+		if strings.EqualFold(canonicalEncoding(v), string(typ)) {
+			return typ, true
+		}
+	}
+	return "", false
 }
 
-type encodeResponseWriter struct {
-	w           http.ResponseWriter
-	typ         EncodingType
-	enc         io.WriteCloser
-	wroteHeader bool
+// isHandled reports whether r is handled by an outer handler of this package.
+func isHandled(r *http.Request) bool {
+	return r.Context().Value(handledKey) != nil
 }
 
-var (
-	_ http.ResponseWriter = (*encodeResponseWriter)(nil)
-)
+// addVary adds field to the Vary header of header, unless it is already listed.
+func addVary(header http.Header, field string) {
+	for _, v := range header.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
 
-func newEncodeResonseWriter(w http.ResponseWriter, typ EncodingType, options *handlerOptions) *encodeResponseWriter {
-	var enc io.WriteCloser
-	switch typ {
-	case Gzip:
-		enc, _ = gzip.NewWriterLevel(w, options.gzipLevel)
-	case Deflate:
-		enc, _ = zlib.NewWriterLevel(w, options.deflateLevel)
-	case Brotli:
-		enc = brotli.NewWriterLevel(w, options.brotliLevel)
+// lookupPrecompression reports whether r requests precompression content,
+// and returns its encoding and the content type of the original content.
+// The returned request is r, or a copy of r for the precompression file if the manifest is used.
+func (h *handler) lookupPrecompression(r *http.Request) (EncodingType, string, *http.Request, bool) {
+	if file, ok := h.options.precompressionManifest[r.URL.Path]; ok {
+		contentType := contentTypeByExtension(path.Ext(r.URL.Path))
+
+		req := r.Clone(r.Context())
+		req.URL.Path = file.Path
+		req.URL.RawPath = ""
+		return file.Encoding, contentType, req, true
 	}
 
-	return &encodeResponseWriter{
-		w:   w,
-		typ: typ,
-		enc: enc,
+	if h.options.disablePrecompression {
+		return "", "", nil, false
 	}
-}
 
-func (w *encodeResponseWriter) Close() error {
-	return w.enc.Close()
-}
+	name := path.Base(r.URL.Path)
+	ext := path.Ext(name)
 
-func (w *encodeResponseWriter) Header() http.Header {
-	return w.w.Header()
-}
+	pre, ok := precompressionEncodeMap[ext]
+	if !ok {
+		return "", "", nil, false
+	}
 
-func (w *encodeResponseWriter) Write(b []byte) (int, error) {
-	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+	origExt := pre.ext
+	if origExt == "" {
+		origExt = path.Ext(name[:len(name)-len(ext)])
+	}
+	if origExt == "" && h.options.precompressionContentType != "" {
+		// The original file has no extension, such as "/data.gz".
+		return pre.encoding, h.options.precompressionContentType, r, true
 	}
-	return w.enc.Write(b)
+	return pre.encoding, contentTypeByExtension(origExt), r, true
 }
 
-func (w *encodeResponseWriter) WriteHeader(statusCode int) {
-	if w.wroteHeader {
-		return
+// openUncompressedSibling opens the uncompressed sibling of the precompression content requested with p
+// in the file system set by PreferUncompressedSibling. It reports false if the sibling does not exist.
+func (h *handler) openUncompressedSibling(p string) (http.File, fs.FileInfo, bool) {
+	if h.options.uncompressedSiblingFS == nil {
+		return nil, nil, false
 	}
-	w.wroteHeader = true
 
-	if contentLength := w.Header().Get("Content-Length"); contentLength != "" {
-		w.Header().Del("Content-Length")
+	name := p
+	if _, ok := h.options.precompressionManifest[p]; !ok {
+		// The path of the original content, such as "/file.txt" for "/file.txt.gz".
+		ext := path.Ext(p)
+		name = p[:len(p)-len(ext)] + precompressionEncodeMap[ext].ext
+	}
+	if strings.HasSuffix(name, "/") {
+		return nil, nil, false
+	}
+
+	f, err := h.options.uncompressedSiblingFS.Open(name)
+	if err != nil {
+		return nil, nil, false
 	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil, nil, false
+	}
+	return f, fi, true
+}
 
-	w.Header().Set(contentEncodingHeader, string(w.typ))
+// supportedEncodings is the encodings supported by default, in order of preference.
+var supportedEncodings = []EncodingType{Brotli, Gzip, Deflate}
 
-	w.w.WriteHeader(statusCode)
+// AcceptedEncodings returns the supported encodings that the client accepts
+// in order of preference, based on the Accept-Encoding header of r.
+// Encodings with a quality value of 0 are excluded, and the wildcard "*"
+// is expanded to the supported encodings that are not listed in the header.
+func AcceptedEncodings(r *http.Request) []EncodingType {
+	return negotiateEncodings(parseAcceptedEncoding(r), supportedEncodings)
 }
 
-type decodeResponseWriter struct {
-	w           http.ResponseWriter
-	typ         EncodingType
-	header      http.Header
-	wroteHeader bool
+// NegotiateEncoding returns the encoding that is the most preferred by the client
+// among available encodings, based on the Accept-Encoding header of r.
+// Encodings with a quality value of 0 are never selected, and the wildcard "*"
+// matches available encodings that are not listed in the header,
+// in order of available.
+// It reports false if no available encoding is acceptable.
+func NegotiateEncoding(r *http.Request, available []EncodingType) (EncodingType, bool) {
+	encs := negotiateEncodings(parseAcceptedEncoding(r), available)
+	if len(encs) == 0 {
+		return "", false
+	}
+	return encs[0], true
+}
 
-	pr   *io.PipeReader
-	pw   *io.PipeWriter
-	once sync.Once
+// A Negotiator selects the encoding of a response.
+type Negotiator interface {
+	// Negotiate returns the encoding of the response to r among available encodings.
+	// It reports false if the response should not be encoded.
+	Negotiate(r *http.Request, available []EncodingType) (EncodingType, bool)
+}
 
-	wg   sync.WaitGroup
-	exit chan struct{}
+// The NegotiatorFunc type is an adapter to allow the use of ordinary functions as a Negotiator.
+type NegotiatorFunc func(r *http.Request, available []EncodingType) (EncodingType, bool)
+
+// Negotiate calls f(r, available).
+func (f NegotiatorFunc) Negotiate(r *http.Request, available []EncodingType) (EncodingType, bool) {
+	return f(r, available)
 }
 
-var (
-	_ http.ResponseWriter = (*decodeResponseWriter)(nil)
-)
+// DefaultNegotiator is the Negotiator that selects the encoding most preferred by the client,
+// as NegotiateEncoding does. It is the negotiation strategy used by default.
+var DefaultNegotiator Negotiator = NegotiatorFunc(NegotiateEncoding)
 
-func newDecodeResonseWriter(w http.ResponseWriter, typ EncodingType, header http.Header) *decodeResponseWriter {
-	pr, pw := io.Pipe()
+// negotiate returns the encodings of the response to r in order of preference.
+// values is the accepted encodings of r, which may be modified by options.
+// It returns nil if encoding is disabled for r by skipReason.
+func (h *handler) negotiate(r *http.Request, values []*httpqv.Value, skipReason string) []EncodingType {
+	if skipReason != "" {
+		return nil
+	}
+	available := h.enabledEncodings()
+	if h.options.negotiator == nil {
+		encs := negotiateEncodings(values, available)
+		if h.options.stableSelection != nil {
+			encs = selectStable(encs, values, h.options.stableSelection(r))
+		}
+		return preferForcedEncoding(r.Context(), encs)
+	}
 
-	return &decodeResponseWriter{
-		w:      w,
-		typ:    typ,
-		header: header,
-		pr:     pr,
-		pw:     pw,
+	enc, ok := h.options.negotiator.Negotiate(r, available)
+	if !ok {
+		return nil
+	}
+	for _, typ := range available {
+		if strings.EqualFold(string(enc), string(typ)) {
+			return []EncodingType{typ}
+		}
 	}
+	// The encoding is not available.
+	return nil
 }
 
-func (w *decodeResponseWriter) Close() error {
-	defer w.wg.Wait()
+// negotiateEncodings returns acceptable encodings among available in order of preference.
+// values must be sorted in order of priority.
+func negotiateEncodings(values []*httpqv.Value, available []EncodingType) []EncodingType {
+	var encs []EncodingType
+	added := map[EncodingType]bool{}
+	for _, v := range values {
+		if v.Priority == 0 {
+			continue
+		}
+		for _, typ := range available {
+			if added[typ] {
+				continue
+			}
+			if v.Value == "*" && !listedEncoding(values, typ) || strings.EqualFold(canonicalEncoding(v.Value), string(typ)) {
+				encs = append(encs, typ)
+				added[typ] = true
+			}
+		}
+	}
 
-	return w.pw.Close()
+	return encs
 }
 
-func (w *decodeResponseWriter) Header() http.Header {
-	return w.w.Header()
+// selectStable moves the encoding chosen by hash to the front of encs, among the most preferred
+// encodings that have the same quality value. values must be sorted in order of priority.
+func selectStable(encs []EncodingType, values []*httpqv.Value, hash uint64) []EncodingType {
+	if len(encs) == 0 {
+		return encs
+	}
+	q := encodingQuality(values, encs[0])
+	n := 1
+	for n < len(encs) && encodingQuality(values, encs[n]) == q {
+		n++
+	}
+	if i := int(hash % uint64(n)); i > 0 {
+		return moveToFront(encs, i)
+	}
+	return encs
 }
 
-func (w *decodeResponseWriter) Write(b []byte) (int, error) {
-	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK)
+// encodingQuality returns the quality value of typ in values, which is the one of "*" if typ is not listed.
+// values must be sorted in order of priority.
+func encodingQuality(values []*httpqv.Value, typ EncodingType) float32 {
+	for _, v := range values {
+		if strings.EqualFold(canonicalEncoding(v.Value), string(typ)) {
+			return v.Priority
+		}
 	}
+	for _, v := range values {
+		if v.Value == "*" {
+			return v.Priority
+		}
+	}
+	return 0
+}
 
-	w.once.Do(func() {
-		w.wg.Add(1)
-		go w.write()
-	})
-
-	n, err := w.pw.Write(b)
-	if err != nil {
-		return 0, fmt.Errorf("httpenc: failed to decode %s: %w", w.typ, err)
+// listedEncoding reports whether typ is listed in values explicitly, even with a quality value of 0.
+func listedEncoding(values []*httpqv.Value, typ EncodingType) bool {
+	for _, v := range values {
+		if strings.EqualFold(canonicalEncoding(v.Value), string(typ)) {
+			return true
+		}
 	}
+	return false
+}
 
-	return n, nil
+// encodingAliases maps the legacy tokens of encodings to the canonical tokens.
+var encodingAliases = map[string]string{
+	"x-gzip":   string(Gzip),
+	"x-brotli": string(Brotli),
 }
 
-func (w *decodeResponseWriter) write() {
-	defer w.wg.Done()
-	defer w.pr.Close()
+// canonicalEncoding returns the canonical token of the encoding token.
+func canonicalEncoding(token string) string {
+	if canonical, ok := encodingAliases[strings.ToLower(token)]; ok {
+		return canonical
+	}
+	return token
+}
 
-	var dec io.ReadCloser
-	switch w.typ {
-	case Gzip:
-		r, err := gzip.NewReader(w.pr)
-		if err != nil {
-			err := fmt.Errorf("httpenc: failed to create gzip.Reader: %w", err)
-			w.pr.CloseWithError(err)
-			return
-		}
-		dec = r
-	case Deflate:
-		r, err := zlib.NewReader(w.pr)
-		if err != nil {
-			err := fmt.Errorf("httpenc: failed to create zlib.Reader: %w", err)
-			w.pr.CloseWithError(err)
-			return
+func parseAcceptedEncoding(r *http.Request) []*httpqv.Value {
+	// Multiple header lines are combined into one comma-separated list.
+	// Empty list elements, such as "gzip,", are ignored as RFC 9110 Section 5.6.1 requires.
+	var elems []string
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, elem := range strings.Split(v, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				elems = append(elems, elem)
+			}
 		}
-		dec = r
-	case Brotli:
-		dec = io.NopCloser(brotli.NewReader(w.pr))
 	}
-	defer dec.Close()
+	if len(elems) == 0 {
+		return nil
+	}
+	s := strings.Join(elems, ",")
 
-	_, err := io.Copy(w.w, dec)
-	if err != nil && err != io.EOF {
-		w.pr.CloseWithError(err)
-		return
+	values, err := httpqv.Parse(s)
+	if err != nil {
+		return nil
 	}
+
+	httpqv.Sort(values)
+
+	return values
 }
 
-func (w *decodeResponseWriter) WriteHeader(statusCode int) {
-	if w.wroteHeader {
-		return
+// acceptsContentType reports whether the Accept header of r accepts contentType.
+// If the Accept header is missing or malformed, it reports true.
+func acceptsContentType(r *http.Request, contentType string) bool {
+	s := r.Header.Get("Accept")
+	if s == "" {
+		return true
 	}
-	w.wroteHeader = true
 
-	for key, values := range w.header {
-		w.Header()[key] = values
+	values, err := httpqv.Parse(s)
+	if err != nil {
+		return true
 	}
 
-	if contentLength := w.Header().Get("Content-Length"); contentLength != "" {
-		w.Header().Del("Content-Length")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
 	}
+	typ, _, _ := strings.Cut(mediaType, "/")
 
-	w.Header().Del(contentEncodingHeader)
+	for _, v := range values {
+		if v.Priority == 0 {
+			continue
+		}
+		accept := strings.ToLower(v.Value)
+		switch {
+		case accept == "*/*", accept == typ+"/*", accept == mediaType:
+			return true
+		}
+	}
 
-	w.w.WriteHeader(statusCode)
+	return false
 }
 
-type headerResponseWriter struct {
+func contentTypeByExtension(ext string) string {
+	typ := mime.TypeByExtension(ext)
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	return typ
+}
+
+// encodeResponseWriter encodes the content written to it and writes the encoded content
+// to the underlying http.ResponseWriter.
+// The encoder is created when the header is written, and the content is not encoded
+// if the response is not to be compressed.
+// If the minimum size is set, the header and the content are held until the size of
+// the content reaches it, or the response is finished, unless the Content-Length header
+// tells the size. If the whole content is held until the response is finished,
+// the header is written with the Content-Length of the encoded content.
+// For HEAD requests, only the headers are modified and no encoder is created.
+type encodeResponseWriter struct {
 	w           http.ResponseWriter
-	header      http.Header
+	r           *http.Request
+	typ         EncodingType
+	head        bool
+	options     *handlerOptions
+	enc         io.WriteCloser
+	encoding    bool
+	acquired    bool
+	disabled    bool
 	wroteHeader bool
+
+	// fallback is the encoding used if the number of brotli encoders reaches the limit.
+	fallback EncodingType
+	// hijacked is true if the connection is taken over by the handler.
+	hijacked bool
+	// mu serializes the methods if ConcurrentSafe is set.
+	mu sync.Mutex
+	// statusCode is the status code written by the handler.
+	statusCode int
+	// committed is true if the header is written to the underlying http.ResponseWriter.
+	committed bool
+	// err is the error passed to the error handler set by OnError.
+	// The content written after it is discarded.
+	err error
+	// buf holds the content written before the header is committed.
+	buf []byte
+	// header holds the header written by WriteHeader until it is committed.
+	header http.Header
+	// start is the time when the encoder is created.
+	start time.Time
+	// memory is the estimated memory of the encoder reserved in the budget set by EncoderMemoryLimit.
+	memory int64
+	// minSize is the size of the content to be held until the header is committed.
+	minSize int
+	// whole is true if the whole content is held until Close.
+	whole bool
+	// encoded holds the encoded content of the whole content, which is written
+	// with the Content-Length header when the encoder is closed.
+	encoded *bytes.Buffer
+	// sniffSize is the size of the content to be held to detect the content type, set by SniffBeforeEncode.
+	sniffSize int
+	// bufferSize is the maximum size of the content to be held until Close, set by BufferResponse.
+	bufferSize int
+
+	// in is the number of bytes written to the encoder, and out counts the encoded bytes.
+	in  int64
+	out *countWriter
 }
 
 var (
-	_ http.ResponseWriter = (*headerResponseWriter)(nil)
+	_ http.ResponseWriter = (*encodeResponseWriter)(nil)
+	_ http.Flusher        = (*encodeResponseWriter)(nil)
+	_ http.Hijacker       = (*encodeResponseWriter)(nil)
+	_ CompressionDisabler = (*encodeResponseWriter)(nil)
 )
 
-func newHeaderResponseWriter(w http.ResponseWriter, header http.Header) *headerResponseWriter {
-
-	return &headerResponseWriter{
-		w:      w,
-		header: header,
-	}
+// CompressionDisabler is implemented by the http.ResponseWriter passed to the handler
+// when the response content is to be encoded.
+// The handler can disable encoding of the response by calling DisableCompression
+// before the header is written.
+type CompressionDisabler interface {
+	DisableCompression()
+}
+
+// newEncodeResonseWriter returns an encodeResponseWriter that encodes with encs[0].
+// encs are the acceptable encodings in order of preference.
+func newEncodeResonseWriter(w http.ResponseWriter, r *http.Request, encs []EncodingType, options *handlerOptions) *encodeResponseWriter {
+	ew := &encodeResponseWriter{
+		w:       w,
+		r:       r,
+		typ:     encs[0],
+		head:    r.Method == http.MethodHead,
+		options: options,
+	}
+	for _, enc := range encs[1:] {
+		if enc != Brotli {
+			ew.fallback = enc
+			break
+		}
+	}
+	return ew
+}
+
+// newEncoder creates an encoder of typ that writes to w.
+// sizeHint is the size of the content to be encoded if it is known, or 0 otherwise.
+// contentType is the Content-Type header of the content, or empty if it is unknown.
+func newEncoder(w io.Writer, typ EncodingType, sizeHint int64, contentType string, options *handlerOptions) (io.WriteCloser, error) {
+	switch typ {
+	case Gzip:
+		return gzip.NewWriterLevel(w, options.gzipLevel)
+	case Deflate:
+		if options.deflateDict != nil {
+			return flate.NewWriterDict(w, options.deflateLevel, options.deflateDict)
+		}
+		return zlib.NewWriterLevel(w, options.deflateLevel)
+	case Brotli:
+		if options.deterministicOutput {
+			// The window size must not depend on the Content-Length header.
+			sizeHint = 0
+		}
+		lgwin := brotliWindowBits(sizeHint)
+		if options.brotliWindowFunc != nil {
+			if bits := options.brotliWindowFunc(contentType, int(sizeHint)); bits != 0 {
+				lgwin = clampBrotliWindowBits(bits)
+			}
+		}
+		return brotli.NewWriterOptions(w, brotli.WriterOptions{
+			Quality: options.brotliLevel,
+			LGWin:   lgwin,
+		}), nil
+	}
+
+	newEncoder, ok := options.customEncoders[typ]
+	if !ok {
+		return nil, &EncodeError{Encoding: typ, Op: "create encoder", Err: errors.New("unsupported encoding")}
+	}
+	enc, err := newEncoder(w)
+	if err != nil {
+		return nil, &EncodeError{Encoding: typ, Op: "create encoder", Err: err}
+	}
+	return enc, nil
+}
+
+// sniffLen is the maximum size of the content used to detect the content type,
+// as http.DetectContentType considers.
+const sniffLen = 512
+
+const (
+	brotliMinWindowBits = 10
+	brotliMaxWindowBits = 24
+)
+
+// brotliWindowBits returns the base 2 logarithm of the brotli window size
+// that is large enough for the content of sizeHint bytes.
+// It returns 0 to use the default window size if sizeHint is unknown.
+func brotliWindowBits(sizeHint int64) int {
+	if sizeHint <= 0 {
+		return 0
+	}
+	bits := brotliMinWindowBits
+	for bits < brotliMaxWindowBits && int64(1)<<bits < sizeHint {
+		bits++
+	}
+	return bits
+}
+
+// clampBrotliWindowBits returns bits limited to the range of the brotli window size.
+func clampBrotliWindowBits(bits int) int {
+	if bits < brotliMinWindowBits {
+		return brotliMinWindowBits
+	}
+	if bits > brotliMaxWindowBits {
+		return brotliMaxWindowBits
+	}
+	return bits
+}
+
+func (w *encodeResponseWriter) Close() error {
+	defer w.lock()()
+
+	if w.hijacked {
+		// The connection is taken over by the handler.
+		if w.acquired {
+			w.releaseEncoder()
+		}
+		return nil
+	}
+	if w.wroteHeader && !w.committed {
+		if len(w.buf) < w.minSize {
+			// The content is smaller than the minimum size.
+			w.options.skip(ReasonMinSize, w.r)
+			w.commit(false)
+		} else {
+			// The whole content is held, so the length of the encoded content can be known.
+			w.whole = true
+			w.commit(w.sniffContentType())
+		}
+		if err := w.writeBuffer(); err != nil {
+			return err
+		}
+	}
+
+	if w.enc == nil {
+		return nil
+	}
+	if w.acquired {
+		defer w.releaseEncoder()
+	}
+	err := w.enc.Close()
+	if w.encoded != nil {
+		if err == nil {
+			w.Header().Set("Content-Length", strconv.Itoa(w.encoded.Len()))
+		}
+		w.w.WriteHeader(w.statusCode)
+		if _, werr := w.w.Write(w.encoded.Bytes()); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	addStats(w.in, w.out.n)
+	if w.options.onEncode != nil {
+		w.options.onEncode(EncodeInfo{
+			Request:     w.r,
+			Encoding:    w.typ,
+			InputBytes:  w.in,
+			OutputBytes: w.out.n,
+			SizeBucket:  sizeBucket(w.in),
+		})
+	}
+	if w.options.metrics != nil {
+		w.options.metrics.ObserveCompression(string(w.typ), w.in, w.out.n, time.Since(w.start))
+	}
+	if err != nil {
+		return &EncodeError{Encoding: w.typ, Op: "encode", Err: err}
+	}
+	return nil
+}
+
+func (w *encodeResponseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *encodeResponseWriter) Write(b []byte) (int, error) {
+	defer w.lock()()
+
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+
+	if !w.committed {
+		w.buf = append(w.buf, b...)
+		if (len(w.buf) < w.minSize || len(w.buf) < w.sniffSize || len(w.buf) <= w.bufferSize) && !w.flushesLine(b) {
+			return len(b), nil
+		}
+		w.commit(w.sniffContentType())
+		if err := w.writeBuffer(); err != nil {
+			return 0, err
+		}
+	} else if n, err := w.write(b); err != nil {
+		return n, err
+	}
+
+	if w.flushesLine(b) {
+		w.flush()
+	}
+	return len(b), nil
+}
+
+// flushesLine reports whether the response is flushed after b is written, set by FlushOnNewline.
+func (w *encodeResponseWriter) flushesLine(b []byte) bool {
+	return w.options.flushOnNewline && bytes.IndexByte(b, '\n') >= 0
+}
+
+func (w *encodeResponseWriter) write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.enc == nil {
+		return w.w.Write(b)
+	}
+	if err := w.r.Context().Err(); err != nil {
+		// The client has gone away, so the content is not encoded in vain.
+		return 0, &EncodeError{Encoding: w.typ, Op: "encode", Err: err}
+	}
+	n, err := w.enc.Write(b)
+	w.in += int64(n)
+	if err != nil {
+		return n, &EncodeError{Encoding: w.typ, Op: "encode", Err: err}
+	}
+	return n, nil
+}
+
+// writeBuffer writes the content held before the header is committed.
+func (w *encodeResponseWriter) writeBuffer() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	b := w.buf
+	w.buf = nil
+	_, err := w.write(b)
+	return err
+}
+
+// Flush flushes the encoder, and then flushes the underlying http.ResponseWriter.
+// If the header is not committed yet, it is committed with the encoder.
+func (w *encodeResponseWriter) Flush() {
+	defer w.lock()()
+
+	w.flush()
+}
+
+func (w *encodeResponseWriter) flush() {
+	if !w.wroteHeader {
+		w.writeHeader(http.StatusOK)
+	}
+	if !w.committed {
+		w.commit(w.sniffContentType())
+		w.writeBuffer()
+	}
+	if f, ok := w.enc.(encodeFlusher); ok {
+		f.Flush()
+	}
+	flush(w.w)
+}
+
+// Hijack lets the handler take over the connection,
+// if the underlying http.ResponseWriter supports it.
+func (w *encodeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	defer w.lock()()
+
+	conn, rw, err := hijack(w.w)
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// DisableCompression disables encoding of the response.
+// It has no effect after the header is committed.
+func (w *encodeResponseWriter) DisableCompression() {
+	defer w.lock()()
+
+	if w.committed {
+		return
+	}
+	w.disabled = true
+}
+
+func (w *encodeResponseWriter) WriteHeader(statusCode int) {
+	defer w.lock()()
+
+	w.writeHeader(statusCode)
+}
+
+// lock locks the writer if ConcurrentSafe is set, and returns the function to unlock it.
+func (w *encodeResponseWriter) lock() func() {
+	if !w.options.concurrentSafe {
+		return func() {}
+	}
+	w.mu.Lock()
+	return w.mu.Unlock
+}
+
+func (w *encodeResponseWriter) writeHeader(statusCode int) {
+	if w.wroteHeader {
+		if w.committed {
+			// The superfluous call is forwarded, so that the underlying writer
+			// ignores and logs it as net/http does.
+			w.w.WriteHeader(statusCode)
+		}
+		return
+	}
+	if isInformational(statusCode) {
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
+	w.statusCode = statusCode
+
+	if enc := strings.TrimSpace(w.Header().Get(contentEncodingHeader)); strings.EqualFold(enc, "identity") {
+		// The identity encoding means no encoding, and it should not be sent in a response.
+		w.Header().Del(contentEncodingHeader)
+		w.disabled = true
+	} else if enc != "" {
+		// The content is already encoded by the handler, such as a reverse proxy.
+		w.options.skip(ReasonEncoded, w.r)
+		w.commit(false)
+		return
+	}
+
+	if w.disabled {
+		w.options.skip(ReasonDisabled, w.r)
+		w.commit(false)
+		return
+	}
+	if statusCode == http.StatusSwitchingProtocols || statusCode == http.StatusNoContent ||
+		statusCode == http.StatusNotModified {
+		// The response has no content to be encoded,
+		// or the connection is switched to another protocol.
+		w.options.skip(ReasonStatus, w.r)
+		w.commit(false)
+		return
+	}
+	if reason := w.options.skipResponse(statusCode, w.Header()); reason != "" {
+		w.options.skip(reason, w.r)
+		w.commit(false)
+		return
+	}
+
+	w.minSize = w.options.minSize
+	if w.minSize > 0 {
+		if n, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil {
+			if n < int64(w.minSize) {
+				// The content is known to be smaller than the minimum size without buffering.
+				w.options.skip(ReasonMinSize, w.r)
+				w.commit(false)
+				return
+			}
+			// The content is known to be large enough.
+			w.minSize = 0
+		}
+	}
+
+	if w.options.sniffBeforeEncode && !w.hasContentType() {
+		// The content is held until it is enough to detect the content type, as net/http does.
+		w.sniffSize = sniffLen
+	}
+	w.bufferSize = w.options.bufferResponse
+
+	if (w.minSize > 0 || w.bufferSize > 0 || !w.hasContentType()) && !w.head {
+		// The header is committed when the size or the type of the content is known.
+		// The header set after WriteHeader must be ignored as http.ResponseWriter does,
+		// so it is restored when committed.
+		w.header = w.Header().Clone()
+		return
+	}
+	w.commit(true)
+}
+
+// restoreHeader restores the header written by WriteHeader, if it is held.
+func (w *encodeResponseWriter) restoreHeader() {
+	if w.header == nil {
+		return
+	}
+	header := w.Header()
+	for key := range header {
+		if _, ok := w.header[key]; !ok {
+			delete(header, key)
+		}
+	}
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.header = nil
+}
+
+// hasContentType reports whether the Content-Type header is set by the handler.
+// A nil value suppresses the detection of the content type.
+func (w *encodeResponseWriter) hasContentType() bool {
+	_, ok := w.Header()["Content-Type"]
+	return ok
+}
+
+// sniffContentType sets the Content-Type header detected from the held content
+// if the handler does not set it, since the underlying http.ResponseWriter would
+// detect it from the encoded content.
+// It reports whether the content is still to be encoded with the detected type.
+func (w *encodeResponseWriter) sniffContentType() bool {
+	w.restoreHeader()
+	if w.hasContentType() {
+		return true
+	}
+	if len(w.buf) == 0 {
+		// The type of empty content is unknown, as the http.ResponseWriter does.
+		w.Header()["Content-Type"] = nil
+		return true
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(w.buf))
+	if reason := w.options.skipResponse(w.statusCode, w.Header()); reason != "" {
+		w.options.skip(reason, w.r)
+		return false
+	}
+	return true
+}
+
+// acquireEncoder acquires the semaphores of encoders without blocking.
+// If the number of brotli encoders reaches the limit, the fallback encoding is used instead.
+// It reports false if no encoder is available.
+func (w *encodeResponseWriter) acquireEncoder() bool {
+	if !w.options.acquireEncoder() {
+		return false
+	}
+	if w.typ == Brotli && !tryAcquire(w.options.brotliSem) {
+		if w.fallback == "" {
+			w.options.releaseEncoder()
+			return false
+		}
+		w.typ = w.fallback
+	}
+
+	// The memory budget is checked after the semaphores, and the encoding is
+	// downshifted to the fallback if the budget is short for a brotli encoder.
+	if !w.reserveMemory() {
+		if w.typ != Brotli || w.fallback == "" {
+			w.releaseEncoder()
+			return false
+		}
+		release(w.options.brotliSem)
+		w.typ = w.fallback
+		if !w.reserveMemory() {
+			w.releaseEncoder()
+			return false
+		}
+	}
+	w.acquired = true
+	return true
+}
+
+// reserveMemory reserves the estimated memory of the encoder in the budget set by EncoderMemoryLimit.
+// It reports false if the budget is short.
+func (w *encodeResponseWriter) reserveMemory() bool {
+	n := w.options.encoderMemory(w.typ)
+	if !w.options.memoryBudget.reserve(n) {
+		return false
+	}
+	w.memory = n
+	return true
+}
+
+func (w *encodeResponseWriter) releaseEncoder() {
+	w.acquired = false
+	if w.typ == Brotli {
+		release(w.options.brotliSem)
+	}
+	w.options.memoryBudget.release(w.memory)
+	w.memory = 0
+	w.options.releaseEncoder()
+}
+
+// commit writes the header to the underlying http.ResponseWriter.
+// If encode is true, the content is encoded if an encoder is available.
+func (w *encodeResponseWriter) commit(encode bool) {
+	w.committed = true
+	w.restoreHeader()
+	// The ETag is weakened whether the response is encoded or not, since a skipped
+	// response may be encoded by another request, and the ETag of a 304 response
+	// must match the one of the 200 response.
+	weakenETag(w.Header())
+
+	if encode && w.disabled {
+		w.options.skip(ReasonDisabled, w.r)
+		encode = false
+	}
+
+	if encode {
+		if w.head {
+			// A response to a HEAD request has no content,
+			// but it has the same headers as the GET response.
+			w.encoding = true
+		} else if !w.acquireEncoder() {
+			w.options.skip(ReasonConcurrency, w.r)
+		} else {
+			// The Content-Length set by the handler is the size of the content to be encoded.
+			sizeHint, _ := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64)
+			var dst io.Writer = w.w
+			if w.whole {
+				// The header is written with the Content-Length after the content is encoded.
+				w.encoded = &bytes.Buffer{}
+				dst = w.encoded
+			}
+			w.out = &countWriter{w: dst}
+			if enc, err := newEncoder(w.out, w.typ, sizeHint, w.Header().Get("Content-Type"), w.options); err == nil {
+				if w.options.writeBufferSize > 0 {
+					enc = newBufferedEncoder(enc, w.options.writeBufferSize)
+				}
+				w.enc = enc
+				w.encoding = true
+				w.start = time.Now()
+			} else {
+				w.encoded = nil
+				w.releaseEncoder()
+				if w.options.onError != nil {
+					// The error handler responds instead of the handler,
+					// and the content written by the handler is discarded.
+					var ee *EncodeError
+					if !errors.As(err, &ee) {
+						err = &EncodeError{Encoding: w.typ, Op: "create encoder", Err: err}
+					}
+					w.err = err
+					w.options.onError(w.w, w.r, err)
+					return
+				}
+				w.options.skip(ReasonEncoderError, w.r)
+			}
+		}
+	}
+
+	if w.encoding {
+		transformHeader(w.Header(), w.options.outputEncoding(w.typ))
+		if w.options.transformationWarning {
+			addTransformationWarning(w.Header())
+		}
+		w.options.setDebugMode(w.Header(), debugModeEncoded)
+	}
+
+	if w.encoded != nil {
+		return
+	}
+	w.w.WriteHeader(w.statusCode)
+}
+
+// decodeBufferSize is the size of the buffer used to copy decoded content
+// to the underlying http.ResponseWriter.
+const decodeBufferSize = 32 * 1024
+
+// decodeResponseWriter decodes the content written to it and writes the decoded content
+// to the underlying http.ResponseWriter.
+//
+// The content is passed to the decoding goroutine through io.Pipe, which does not buffer
+// nor copy the written bytes; Write blocks until the goroutine has consumed all of them.
+// Therefore, the memory used by the writer does not depend on the size of a single Write.
+// It is bounded by the decoder state and a copy buffer of decodeBufferSize bytes,
+// even if the whole content is written at once to a slow client.
+//
+// The whole content written at once, as the Content-Length header tells, is decoded
+// synchronously without the goroutine, since nothing is streamed across Writes.
+type decodeResponseWriter struct {
+	w           http.ResponseWriter
+	typ         EncodingType
+	header      http.Header
+	options     *handlerOptions
+	decoding    bool
+	wroteHeader bool
+	hijacked    bool
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+	// bw buffers the writes to the pipe, set by DecodePipeBuffer.
+	bw *bufio.Writer
+	// streaming is true if the decoding goroutine is started.
+	streaming bool
+	// decoded is true if the whole content is decoded synchronously.
+	decoded bool
+	// contentLength is the length of the content to be decoded, or -1 if it is unknown.
+	contentLength int64
+
+	// exit is closed when the decoding goroutine exits.
+	exit chan struct{}
+	// err is the error of decoding, such as by the truncated content.
+	err error
+}
+
+var (
+	_ http.ResponseWriter = (*decodeResponseWriter)(nil)
+	_ http.Hijacker       = (*decodeResponseWriter)(nil)
+)
+
+func newDecodeResonseWriter(w http.ResponseWriter, typ EncodingType, header http.Header, options *handlerOptions) *decodeResponseWriter {
+	pr, pw := io.Pipe()
+
+	return &decodeResponseWriter{
+		w:       w,
+		typ:     typ,
+		header:  header,
+		options: options,
+		pr:      pr,
+		pw:      pw,
+		exit:    make(chan struct{}),
+
+		contentLength: -1,
+	}
+}
+
+func (w *decodeResponseWriter) Close() error {
+	if !w.wroteHeader && !w.hijacked {
+		// Write the header so that the Content-Encoding header set by the handler
+		// is not sent with the response.
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.streaming {
+		w.pw.Close()
+		if w.err != nil {
+			return &EncodeError{Encoding: w.typ, Op: "decode", Err: w.err}
+		}
+		return nil
+	}
+
+	var err error
+	if w.bw != nil {
+		err = w.bw.Flush()
+	}
+	// Closing the pipe lets the decoding goroutine read EOF and exit.
+	// The goroutine may be blocked by the underlying writer to a slow client,
+	// but it is waited for, since the writer must not be used after the handler returns.
+	// A stalled client is cut off by the write timeout of the server.
+	w.pw.Close()
+	<-w.exit
+
+	if w.err != nil {
+		// The error of decoding is the cause of the error of flushing.
+		err = w.err
+	}
+	if err != nil {
+		return &EncodeError{Encoding: w.typ, Op: "decode", Err: err}
+	}
+	return nil
+}
+
+// Hijack lets the handler take over the connection,
+// if the underlying http.ResponseWriter supports it.
+func (w *decodeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(w.w)
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (w *decodeResponseWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+func (w *decodeResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decoding {
+		return w.w.Write(b)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if w.decoded {
+		return 0, &EncodeError{Encoding: w.typ, Op: "decode", Err: errors.New("content after the end of the encoded stream")}
+	}
+
+	if !w.streaming {
+		if int64(len(b)) == w.contentLength {
+			// The whole content is written at once.
+			w.decoded = true
+			if err := w.decodeSync(b); err != nil {
+				w.err = err
+				return 0, &EncodeError{Encoding: w.typ, Op: "decode", Err: err}
+			}
+			return len(b), nil
+		}
+
+		w.streaming = true
+		if w.options.decodePipeBuffer > 0 {
+			w.bw = bufio.NewWriterSize(w.pw, w.options.decodePipeBuffer)
+		}
+		go w.write()
+	}
+
+	n, err := w.writePipe(b)
+	if err != nil {
+		return 0, &EncodeError{Encoding: w.typ, Op: "decode", Err: err}
+	}
+
+	return n, nil
+}
+
+// writePipe writes b to the decoding goroutine.
+// It blocks until the goroutine has consumed b, so it reports the stall
+// if the client is slow to receive the decoded content.
+func (w *decodeResponseWriter) writePipe(b []byte) (int, error) {
+	var pw io.Writer = w.pw
+	if w.bw != nil {
+		pw = w.bw
+	}
+	return w.writeWatched(pw, b)
+}
+
+// writeWatched writes b to dst, and calls the function set by OnDecodeStall
+// by a watchdog timer if the write is blocked for the threshold.
+func (w *decodeResponseWriter) writeWatched(dst io.Writer, b []byte) (int, error) {
+	if w.options.onDecodeStall == nil {
+		return dst.Write(b)
+	}
+
+	start := time.Now()
+	timer := time.AfterFunc(w.options.decodeStallThreshold, func() {
+		w.options.onDecodeStall(time.Since(start))
+	})
+	defer timer.Stop()
+
+	return dst.Write(b)
+}
+
+// stallWatchWriter writes to the underlying http.ResponseWriter of w, watching the stall of the writes.
+type stallWatchWriter struct {
+	w *decodeResponseWriter
+}
+
+func (sw stallWatchWriter) Write(b []byte) (int, error) {
+	return sw.w.writeWatched(sw.w.w, b)
+}
+
+// decodeSync decodes b synchronously.
+func (w *decodeResponseWriter) decodeSync(b []byte) error {
+	dec, err := newDecoder(bytes.NewReader(b), w.typ, w.options.deflateDict)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	// Nothing is written to the pipe, so the writes to the client are watched instead.
+	var dst io.Writer = onlyWriter{w.w}
+	if w.options.onDecodeStall != nil {
+		dst = stallWatchWriter{w}
+	}
+
+	buf := make([]byte, decodeBufferSize)
+	_, err = io.CopyBuffer(dst, dec, buf)
+	return err
+}
+
+func (w *decodeResponseWriter) write() {
+	defer close(w.exit)
+	defer w.pr.Close()
+
+	dec, err := newDecoder(w.pr, w.typ, w.options.deflateDict)
+	if err != nil {
+		w.err = err
+		w.pr.CloseWithError(err)
+		return
+	}
+	defer dec.Close()
+
+	buf := make([]byte, decodeBufferSize)
+	_, err = io.CopyBuffer(onlyWriter{w.w}, dec, buf)
+	if err != nil && err != io.EOF {
+		w.err = err
+		w.pr.CloseWithError(err)
+		return
+	}
+}
+
+func (w *decodeResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		// The underlying writer ignores and logs the superfluous call.
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	if isInformational(statusCode) {
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	w.wroteHeader = true
+
+	// The content of an error response is not the precompression content.
+	// A partial content of the precompression content can not be decoded.
+	w.decoding = isSuccess(statusCode) && statusCode != http.StatusPartialContent
+	if w.decoding {
+		copyHeader(w.Header(), w.header)
+		w.contentLength = transformHeader(w.Header(), "")
+	}
+
+	w.w.WriteHeader(statusCode)
+}
+
+// newDecoder creates a decoder of typ that reads from r.
+// dict is the preset dictionary of the deflate content, or nil if it has no dictionary.
+func newDecoder(r io.Reader, typ EncodingType, dict []byte) (io.ReadCloser, error) {
+	switch typ {
+	case Gzip:
+		dec, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip.Reader: %w", err)
+		}
+		return dec, nil
+	case Deflate:
+		// Some servers send the raw deflate data without the zlib wrapper as deflate.
+		br := bufio.NewReader(r)
+		if header, err := br.Peek(2); err == nil && !isZlibHeader(header) {
+			if dict != nil {
+				return flate.NewReaderDict(br, dict), nil
+			}
+			return flate.NewReader(br), nil
+		}
+		dec, err := zlib.NewReaderDict(br, dict)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zlib.Reader: %w", err)
+		}
+		return dec, nil
+	case Brotli:
+		src := &probeReader{r: r}
+		return io.NopCloser(&brotliReader{r: brotli.NewReader(src), src: src}), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", typ)
+}
+
+// errBrotliExcessiveInput is the error of brotli.Reader for the input after the end of the stream.
+var errBrotliExcessiveInput = func() error {
+	// The empty stream followed by a byte.
+	_, err := brotli.NewReader(bytes.NewReader([]byte{0x3b, 0})).Read(make([]byte, 1))
+	return err
+}()
+
+// brotliReader is the brotli decoder that reports io.ErrUnexpectedEOF for the truncated stream.
+// brotli.Reader returns io.EOF when the source ends at the boundary of a meta-block,
+// even if the stream is not finished. Therefore, a probe byte is read after the end of the source:
+// the finished stream rejects it as the excessive input, and the truncated stream consumes it.
+type brotliReader struct {
+	r   *brotli.Reader
+	src *probeReader
+	err error
+}
+
+func (r *brotliReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.r.Read(p)
+	if !r.src.probed {
+		return n, err
+	}
+
+	// The output of the probe byte is discarded.
+	if err == errBrotliExcessiveInput && n == 0 {
+		r.err = io.EOF
+	} else {
+		r.err = io.ErrUnexpectedEOF
+	}
+	return 0, r.err
+}
+
+// probeReader reads a zero byte once after the end of r.
+type probeReader struct {
+	r      io.Reader
+	probed bool
+}
+
+func (r *probeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n == 0 && err == io.EOF && !r.probed && len(p) > 0 {
+		r.probed = true
+		p[0] = 0
+		return 1, nil
+	}
+	return n, err
+}
+
+// isZlibHeader reports whether b starts with the zlib header of the deflate method.
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// isInformational reports whether statusCode is an informational status code (1xx),
+// which can be written multiple times before the final response.
+// 101 Switching Protocols is not included since it is the final response.
+func isInformational(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+}
+
+// isSuccess reports whether statusCode is a successful status code (2xx).
+func isSuccess(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// onlyWriter hides the optional interfaces of the underlying writer,
+// such as io.ReaderFrom, so that io.CopyBuffer uses the given buffer.
+type onlyWriter struct {
+	io.Writer
+}
+
+type headerResponseWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+var (
+	_ http.ResponseWriter = (*headerResponseWriter)(nil)
+	_ http.Flusher        = (*headerResponseWriter)(nil)
+	_ http.Hijacker       = (*headerResponseWriter)(nil)
+	_ io.ReaderFrom       = (*headerResponseWriter)(nil)
+)
+
+func newHeaderResponseWriter(w http.ResponseWriter, header http.Header) *headerResponseWriter {
+
+	return &headerResponseWriter{
+		w:      w,
+		header: header,
+	}
 }
 
 func (w *headerResponseWriter) Close() error {
@@ -337,23 +1723,509 @@ func (w *headerResponseWriter) Write(b []byte) (int, error) {
 	return w.w.Write(b)
 }
 
+// ReadFrom copies the content from src to the underlying http.ResponseWriter as is.
+// A large precompression file is streamed without buffering, and with sendfile
+// if the underlying writer supports io.ReaderFrom.
+func (w *headerResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if rf, ok := w.w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return io.Copy(onlyWriter{w.w}, src)
+}
+
+func (w *headerResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	flush(w.w)
+}
+
+// Hijack lets the handler take over the connection,
+// if the underlying http.ResponseWriter supports it.
+func (w *headerResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.w)
+}
+
 func (w *headerResponseWriter) WriteHeader(statusCode int) {
 	if w.wroteHeader {
+		// The underlying writer ignores and logs the superfluous call.
+		w.w.WriteHeader(statusCode)
+		return
+	}
+	if isInformational(statusCode) {
+		w.w.WriteHeader(statusCode)
 		return
 	}
 	w.wroteHeader = true
 
-	for key, values := range w.header {
-		w.Header()[key] = values
+	// The content of an error response is not the precompression content.
+	if isSuccess(statusCode) {
+		copyHeader(w.Header(), w.header)
+	}
+
+	w.w.WriteHeader(statusCode)
+}
+
+// transformHeader modifies header for the content encoded with enc, or decoded if enc is empty.
+// The Content-Length header is removed since it is not the length of the transformed content,
+// and the length is returned, or -1 if it is unknown.
+func transformHeader(header http.Header, enc EncodingType) int64 {
+	contentLength := int64(-1)
+	if v := header.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			contentLength = n
+		}
+		header.Del("Content-Length")
+	}
+
+	if enc == "" {
+		header.Del(contentEncodingHeader)
+	} else {
+		header.Set(contentEncodingHeader, string(enc))
+	}
+
+	return contentLength
+}
+
+// weakenETag makes the strong ETag of header weak, since the encoded content is
+// semantically equivalent to, but not byte-for-byte identical with the original content.
+// The If-None-Match header is evaluated with the weak comparison, so a conditional
+// request with the weak ETag still yields 304 Not Modified.
+func weakenETag(header http.Header) {
+	etag := header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return
+	}
+	header.Set("ETag", "W/"+etag)
+}
+
+// copyHeader copies the values of src to dst.
+// The values are copied so that dst never shares the underlying arrays with src,
+// even if src is shared by multiple responses.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		dst[key] = append([]string(nil), values...)
+	}
+}
+
+// bufferedEncoder buffers small writes in front of an encoder.
+type bufferedEncoder struct {
+	*bufio.Writer
+	enc io.WriteCloser
+}
+
+func newBufferedEncoder(enc io.WriteCloser, size int) *bufferedEncoder {
+	return &bufferedEncoder{
+		Writer: bufio.NewWriterSize(enc, size),
+		enc:    enc,
+	}
+}
+
+// Flush writes the buffered data to the encoder, and then flushes the encoder.
+func (e *bufferedEncoder) Flush() error {
+	if err := e.Writer.Flush(); err != nil {
+		return err
+	}
+	if f, ok := e.enc.(encodeFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close writes the buffered data to the encoder, and then closes the encoder.
+func (e *bufferedEncoder) Close() error {
+	if err := e.Writer.Flush(); err != nil {
+		e.enc.Close()
+		return err
+	}
+	return e.enc.Close()
+}
+
+// encodeFlusher is implemented by encoders that can flush pending data,
+// such as *gzip.Writer, *zlib.Writer and *brotli.Writer.
+type encodeFlusher interface {
+	Flush() error
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// errHijackNotSupported is returned by Hijack if the underlying http.ResponseWriter
+// does not support it.
+var errHijackNotSupported = errors.New("httpenc: http.Hijacker is not supported")
+
+// hijack takes over the connection of w, if w supports it.
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errHijackNotSupported
+	}
+	return hj.Hijack()
+}
+
+type handlerOptions struct {
+	gzipLevel    int
+	deflateLevel int
+	brotliLevel  int
+
+	deflateDict []byte
+
+	encodingAliases map[EncodingType]string
+
+	brotliWindowFunc func(contentType string, sizeHint int) int
+
+	validatePrecompressAccept bool
+
+	// encodings is the available encodings in order of server preference.
+	encodings      []EncodingType
+	customEncoders map[EncodingType]EncoderFunc
+
+	compressStatuses    map[int]bool
+	compressEventStream bool
+
+	cacheKeyFunc    func(r *http.Request) (string, bool)
+	cacheMaxEntries int
+	cacheMaxBytes   int
+
+	skipUserAgent func(ua string) bool
+
+	noCompressQueryParam string
+
+	encoderSem   chan struct{}
+	brotliSem    chan struct{}
+	memoryBudget *memoryBudget
+
+	minSize           int
+	writeBufferSize   int
+	flushOnNewline    bool
+	sniffBeforeEncode bool
+	bufferResponse    int
+	skipContentTypes  *contentTypeMatcher
+
+	compressContentTypes *contentTypeMatcher
+	respectNoTransform   bool
+
+	skipCompressedAttachments bool
+
+	deterministicOutput bool
+
+	assumeGzip bool
+
+	transformationWarning bool
+
+	precompressionContentType string
+
+	skipFetchDests map[string]bool
+
+	disablePrecompression bool
+
+	uncompressedSiblingFS http.FileSystem
+
+	assumeBrotliUA func(ua string) bool
+
+	onEncode func(info EncodeInfo)
+	metrics  MetricsSink
+
+	concurrentSafe bool
+
+	disableVary bool
+
+	debugHeaders bool
+
+	negotiator Negotiator
+
+	stableSelection func(r *http.Request) uint64
+
+	decodePipeBuffer     int
+	decodeStallThreshold time.Duration
+	onDecodeStall        func(d time.Duration)
+	onSkip               func(reason string, r *http.Request)
+	onError              func(w http.ResponseWriter, r *http.Request, err error)
+
+	transcodePrecompression bool
+	precompressionManifest  map[string]PrecompressedFile
+}
+
+// skipRequest returns the reason why encoding is disabled for r,
+// or an empty string if it is not disabled.
+func (opts *handlerOptions) skipRequest(r *http.Request) string {
+	if opts.skipUserAgent != nil && opts.skipUserAgent(r.UserAgent()) {
+		return ReasonUserAgent
+	}
+	if opts.noCompressQueryParam != "" {
+		if values, ok := r.URL.Query()[opts.noCompressQueryParam]; ok {
+			if v := values[0]; v == "" {
+				return ReasonQueryParam
+			} else if b, err := strconv.ParseBool(v); err == nil && b {
+				return ReasonQueryParam
+			}
+		}
+	}
+	return ""
+}
+
+// acquireEncoder acquires the semaphore of encoders without blocking.
+// It reports false if the number of encoders reaches the limit.
+func (opts *handlerOptions) acquireEncoder() bool {
+	return tryAcquire(opts.encoderSem)
+}
+
+func (opts *handlerOptions) releaseEncoder() {
+	release(opts.encoderSem)
+}
+
+// encoderMemory returns the rough estimate of the memory used by an encoder of typ
+// at the compression level of the options.
+func (opts *handlerOptions) encoderMemory(typ EncodingType) int64 {
+	switch typ {
+	case Gzip:
+		return flateEncoderMemory(opts.gzipLevel)
+	case Deflate:
+		return flateEncoderMemory(opts.deflateLevel)
+	case Brotli:
+		switch {
+		case opts.brotliLevel <= 1:
+			return 1 << 20
+		case opts.brotliLevel <= 9:
+			return 8 << 20
+		default:
+			// The highest levels use the large hash tables and the optimal parsing.
+			return 32 << 20
+		}
+	}
+	return 1 << 20
+}
+
+// flateEncoderMemory returns the rough estimate of the memory used by a flate encoder at the level.
+func flateEncoderMemory(level int) int64 {
+	if level == flate.NoCompression || level == flate.HuffmanOnly {
+		// The hash tables are not used.
+		return 64 << 10
+	}
+	return 1 << 20
+}
+
+// memoryBudget limits the total estimated memory of encoders.
+// A nil budget is unlimited.
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// reserve reserves n bytes without blocking. It reports false if the budget is short.
+func (b *memoryBudget) reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+// release releases n bytes reserved by reserve.
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+}
+
+// tryAcquire acquires the semaphore sem without blocking.
+// It reports false if sem is full. A nil sem is never full.
+func tryAcquire(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release releases the semaphore sem acquired by tryAcquire.
+func release(sem chan struct{}) {
+	if sem == nil {
+		return
+	}
+	<-sem
+}
+
+// skipResponse returns the reason why a response with statusCode and header is not to be compressed,
+// or an empty string if it is to be compressed.
+func (opts *handlerOptions) skipResponse(statusCode int, header http.Header) string {
+	if statusCode == http.StatusPartialContent || statusCode == http.StatusRequestedRangeNotSatisfiable ||
+		header.Get("Content-Range") != "" {
+		// The Content-Range header is for the unencoded content,
+		// so the encoded part of it is not valid.
+		return ReasonStatus
+	}
+	if opts.compressStatuses != nil && !opts.compressStatuses[statusCode] {
+		return ReasonStatus
+	}
+
+	mediaType := mediaTypeOf(header)
+	if mediaType == eventStreamMediaType && !opts.compressEventStream {
+		// Server-sent events are delivered promptly without buffering of an encoder.
+		return ReasonEventStream
+	}
+	if opts.skipContentTypes.match(mediaType) {
+		return ReasonContentType
+	}
+	if opts.compressContentTypes != nil && mediaType != "" && !opts.compressContentTypes.match(mediaType) {
+		return ReasonContentType
+	}
+	if opts.respectNoTransform && hasNoTransform(header) {
+		return ReasonNoTransform
+	}
+	if opts.skipCompressedAttachments && isCompressedAttachment(header) {
+		return ReasonAttachment
+	}
+
+	return ""
+}
+
+// hasNoTransform reports whether the Cache-Control header of header has the no-transform directive.
+func hasNoTransform(header http.Header) bool {
+	return hasCacheControl(header, "no-transform")
+}
+
+// hasCacheControl reports whether the Cache-Control header of header has the directive name,
+// with or without an argument.
+func hasCacheControl(header http.Header, name string) bool {
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive, _, _ = strings.Cut(directive, "=")
+			if strings.EqualFold(strings.TrimSpace(directive), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressedExts is the extensions of the files that are already compressed.
+var compressedExts = map[string]bool{
+	".7z": true, ".br": true, ".bz2": true, ".gz": true, ".lz": true, ".lzma": true,
+	".rar": true, ".tgz": true, ".xz": true, ".zip": true, ".zst": true,
+	".avif": true, ".gif": true, ".jpeg": true, ".jpg": true, ".png": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".ogg": true, ".webm": true,
+}
+
+// isCompressedAttachment reports whether the Content-Disposition header of header
+// is an attachment with the filename of an already compressed file.
+func isCompressedAttachment(header http.Header) bool {
+	disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" {
+		return false
+	}
+	return compressedExts[strings.ToLower(path.Ext(params["filename"]))]
+}
+
+// skip calls the OnSkip function with reason, if any.
+func (opts *handlerOptions) skip(reason string, r *http.Request) {
+	if opts.onSkip != nil {
+		opts.onSkip(reason, r)
+	}
+}
+
+// debugModeHeader is the header set by DebugHeaders, which tells how the response is handled.
+const debugModeHeader = "X-Httpenc-Mode"
+
+const (
+	debugModePrecompressed = "precompressed"
+	debugModeEncoded       = "encoded"
+	debugModeDecoded       = "decoded"
+	debugModePassthrough   = "passthrough"
+)
+
+// setDebugMode sets the debug header of mode to header if DebugHeaders is set.
+func (opts *handlerOptions) setDebugMode(header http.Header, mode string) {
+	if opts.debugHeaders {
+		header.Set(debugModeHeader, mode)
+	}
+}
+
+// outputEncoding returns the token of enc set to the Content-Encoding header,
+// which is the alias set by OutputEncodingAlias if any.
+func (opts *handlerOptions) outputEncoding(enc EncodingType) EncodingType {
+	if alias, ok := opts.encodingAliases[enc]; ok {
+		return EncodingType(alias)
+	}
+	return enc
+}
+
+const eventStreamMediaType = "text/event-stream"
+
+// mediaTypeOf returns the lower-cased media type of the Content-Type header without parameters.
+func mediaTypeOf(header http.Header) string {
+	typ, _, _ := strings.Cut(header.Get(contentTypeHeader), ";")
+	return strings.ToLower(strings.TrimSpace(typ))
+}
+
+// contentTypeMatcher matches media types against exact types and wildcard patterns.
+type contentTypeMatcher struct {
+	exact    map[string]bool
+	prefixes []string // such as "text/" for "text/*"
+	suffixes []string // such as "+json" for "*/*+json"
+	any      bool
+}
+
+// add adds the pattern typ to m.
+func (m *contentTypeMatcher) add(typ string) {
+	typ = strings.ToLower(strings.TrimSpace(typ))
+	switch {
+	case typ == "*" || typ == "*/*":
+		m.any = true
+	case strings.HasPrefix(typ, "*/*+"):
+		m.suffixes = append(m.suffixes, typ[len("*/*"):])
+	case strings.HasPrefix(typ, "*+"):
+		m.suffixes = append(m.suffixes, typ[len("*"):])
+	case strings.HasSuffix(typ, "/*"):
+		m.prefixes = append(m.prefixes, typ[:len(typ)-len("*")])
+	default:
+		if m.exact == nil {
+			m.exact = map[string]bool{}
+		}
+		m.exact[typ] = true
 	}
-
-	w.w.WriteHeader(statusCode)
 }
 
-type handlerOptions struct {
-	gzipLevel    int
-	deflateLevel int
-	brotliLevel  int
+// match reports whether the lower-cased mediaType matches any pattern of m.
+func (m *contentTypeMatcher) match(mediaType string) bool {
+	if m == nil || mediaType == "" {
+		return false
+	}
+	if m.any || m.exact[mediaType] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	for _, suffix := range m.suffixes {
+		if strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
 }
 
 type Option interface {
@@ -368,8 +2240,8 @@ func (f optionFunc) apply(opts *handlerOptions) {
 
 func GzipLevel(level int) Option {
 	return optionFunc(func(opts *handlerOptions) {
-		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
-			panic(fmt.Errorf("httpenc: gzip: invalid compression level: %d", level))
+		if err := validateLevel(Gzip, level); err != nil {
+			panic(err)
 		}
 		opts.gzipLevel = level
 	})
@@ -377,8 +2249,8 @@ func GzipLevel(level int) Option {
 
 func DeflateLevel(level int) Option {
 	return optionFunc(func(opts *handlerOptions) {
-		if level < zlib.HuffmanOnly || level > zlib.BestCompression {
-			panic(fmt.Errorf("httpenc: zlib: invalid compression level: %d", level))
+		if err := validateLevel(Deflate, level); err != nil {
+			panic(err)
 		}
 		opts.deflateLevel = level
 	})
@@ -386,9 +2258,658 @@ func DeflateLevel(level int) Option {
 
 func BrotliLevel(level int) Option {
 	return optionFunc(func(opts *handlerOptions) {
-		if level < brotli.BestSpeed || level > brotli.BestCompression {
-			panic(fmt.Errorf("httpenc: brotli: invalid compression level: %d", level))
+		if err := validateLevel(Brotli, level); err != nil {
+			panic(err)
 		}
 		opts.brotliLevel = level
 	})
 }
+
+// validateLevel returns an error if level is not a valid compression level of typ.
+func validateLevel(typ EncodingType, level int) error {
+	switch typ {
+	case Gzip:
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return fmt.Errorf("httpenc: gzip: invalid compression level: %d", level)
+		}
+	case Deflate:
+		if level < zlib.HuffmanOnly || level > zlib.BestCompression {
+			return fmt.Errorf("httpenc: zlib: invalid compression level: %d", level)
+		}
+	case Brotli:
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return fmt.Errorf("httpenc: brotli: invalid compression level: %d", level)
+		}
+	default:
+		return fmt.Errorf("httpenc: unsupported encoding: %s", typ)
+	}
+	return nil
+}
+
+// Levels returns an Option that sets the compression levels of gzip, deflate and brotli at once.
+// It panics if any of the levels is invalid, as GzipLevel, DeflateLevel and BrotliLevel do.
+func Levels(gzipLevel, deflateLevel, brotliLevel int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		GzipLevel(gzipLevel).apply(opts)
+		DeflateLevel(deflateLevel).apply(opts)
+		BrotliLevel(brotliLevel).apply(opts)
+	})
+}
+
+// availableCPUs returns the number of CPUs available to the process.
+// It is a variable so that tests can replace it.
+var availableCPUs = func() int {
+	n := runtime.NumCPU()
+	if p := runtime.GOMAXPROCS(0); p < n {
+		n = p
+	}
+	return n
+}
+
+// AutoLevel returns an Option that sets the compression levels based on the number of
+// available CPUs. It favors speed on small instances, and ratio on large instances.
+func AutoLevel() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		switch n := availableCPUs(); {
+		case n <= 2:
+			Levels(gzip.BestSpeed, zlib.BestSpeed, 2).apply(opts)
+		case n <= 8:
+			Levels(gzip.DefaultCompression, zlib.DefaultCompression, brotli.DefaultCompression).apply(opts)
+		default:
+			Levels(8, 8, 8).apply(opts)
+		}
+	})
+}
+
+// DeflateDictionary returns an Option that sets the preset dictionary of the deflate encoding.
+// With the dictionary, a response is encoded as the raw deflate data compressed with
+// flate.NewWriterDict, without the zlib wrapper, and the precompression content of deflate
+// is decoded with the dictionary. The client must be able to decode the content with the same dictionary.
+func DeflateDictionary(dict []byte) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.deflateDict = append([]byte(nil), dict...)
+	})
+}
+
+// BrotliWindowByContentType returns an Option that sets the function deciding the base 2 logarithm
+// of the brotli window size by the Content-Type header and the size of the content.
+// sizeHint is the Content-Length set by the handler, or 0 if it is unknown.
+// If f returns 0, the window size is decided by sizeHint as usual.
+// The returned value is limited to the range from 10 to 24.
+func BrotliWindowByContentType(f func(contentType string, sizeHint int) int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.brotliWindowFunc = f
+	})
+}
+
+// ValidatePrecompressAccept returns an Option that validates the Accept header
+// of a request for precompression content.
+// If the client does not accept the content type of the precompression content,
+// the handler responds with 406 Not Acceptable.
+// Accept is added to the Vary header of the response, unless DisableVary is set.
+func ValidatePrecompressAccept() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.validatePrecompressAccept = true
+	})
+}
+
+// EncoderFunc creates a writer that encodes content written to it and writes
+// the encoded content to w.
+type EncoderFunc func(w io.Writer) (io.WriteCloser, error)
+
+// CustomEncoder returns an Option that registers an encoder for the content-coding typ.
+// The token typ is matched case-insensitively against the Accept-Encoding header,
+// and is set to the Content-Encoding header verbatim.
+// Custom encodings are less preferred than built-in encodings for the wildcard "*".
+//
+// The package does not depend on a zstd implementation, but zstd can be registered with CustomEncoder.
+// An encoder configured with a dictionary, such as by zstd.WithEncoderDict of
+// github.com/klauspost/compress, can be returned by newEncoder as well,
+// but the client must be able to decode the content with the same dictionary.
+func CustomEncoder(typ EncodingType, newEncoder EncoderFunc) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if typ == "" || newEncoder == nil {
+			panic(fmt.Errorf("httpenc: invalid custom encoder: %q", typ))
+		}
+		if opts.customEncoders == nil {
+			opts.customEncoders = map[EncodingType]EncoderFunc{}
+		}
+		if _, ok := opts.customEncoders[typ]; !ok {
+			opts.encodings = append(opts.encodings, typ)
+		}
+		opts.customEncoders[typ] = newEncoder
+	})
+}
+
+// OutputEncodingAlias returns an Option that sets token to the Content-Encoding header
+// of a response encoded with enc instead of enc itself, such as "x-gzip" for legacy clients.
+// The Accept-Encoding header is still negotiated with the canonical tokens.
+func OutputEncodingAlias(enc EncodingType, token string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if enc == "" || token == "" || strings.ContainsAny(token, " \t,;") {
+			panic(fmt.Errorf("httpenc: invalid encoding alias: %q", token))
+		}
+		if opts.encodingAliases == nil {
+			opts.encodingAliases = map[EncodingType]string{}
+		}
+		opts.encodingAliases[enc] = token
+	})
+}
+
+// CompressStatuses returns an Option that limits the status codes of responses to be compressed.
+// By default, responses with any status code except 206 Partial Content and 416 Range Not Satisfiable
+// are compressed, and a 206 or 416 response is never compressed even if codes has it.
+func CompressStatuses(codes ...int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.compressStatuses = map[int]bool{}
+		for _, code := range codes {
+			if code < 100 || code > 999 {
+				panic(fmt.Errorf("httpenc: invalid status code: %d", code))
+			}
+			opts.compressStatuses[code] = true
+		}
+	})
+}
+
+// CacheKeyFunc returns an Option that enables the cache of encoded responses.
+// The function f returns the cache key of a request, or false if the response is not to be cached.
+// Successful responses of GET requests are cached for each key and encoding,
+// and served from the cache without calling the next handler.
+// Only the header set by the next handler is cached, and the header set by outer handlers
+// for the request is not overwritten by it. A response with the Set-Cookie header set by
+// the next handler, or with the private or no-store directive of Cache-Control, is not cached.
+func CacheKeyFunc(f func(r *http.Request) (string, bool)) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.cacheKeyFunc = f
+	})
+}
+
+// CacheLimits returns an Option that sets the maximum number of entries and
+// the maximum total size in bytes of the cache enabled by CacheKeyFunc.
+// By default, the cache holds up to 100 entries and 10 MiB.
+func CacheLimits(maxEntries, maxBytes int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if maxEntries <= 0 || maxBytes <= 0 {
+			panic(fmt.Errorf("httpenc: invalid cache limits: %d entries, %d bytes", maxEntries, maxBytes))
+		}
+		opts.cacheMaxEntries = maxEntries
+		opts.cacheMaxBytes = maxBytes
+	})
+}
+
+// SkipUserAgent returns an Option that disables encoding for clients whose User-Agent
+// header matches f. Such clients are treated as if they accept no encodings,
+// so precompression content is decoded for them.
+func SkipUserAgent(f func(ua string) bool) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.skipUserAgent = f
+	})
+}
+
+// AssumeBrotliForUA returns an Option that assumes that the client accepts brotli
+// if its User-Agent header matches f, even if the Accept-Encoding header does not list br,
+// such as behind a proxy that strips it. br refused explicitly with q=0 is not assumed.
+func AssumeBrotliForUA(f func(ua string) bool) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.assumeBrotliUA = f
+	})
+}
+
+// SkipByFetchDest returns an Option that disables encoding of responses to requests
+// whose Sec-Fetch-Dest header is one of dests, such as "image", "video", "audio" and "font".
+// Unlike SkipUserAgent, precompression content is still served as is.
+func SkipByFetchDest(dests ...string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if opts.skipFetchDests == nil {
+			opts.skipFetchDests = map[string]bool{}
+		}
+		for _, dest := range dests {
+			opts.skipFetchDests[strings.ToLower(dest)] = true
+		}
+	})
+}
+
+// MaxConcurrentEncoders returns an Option that limits the number of responses
+// encoded simultaneously to n. Responses beyond the limit are not encoded.
+// Decoding precompression content is not limited.
+func MaxConcurrentEncoders(n int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if n <= 0 {
+			panic(fmt.Errorf("httpenc: invalid max concurrent encoders: %d", n))
+		}
+		opts.encoderSem = make(chan struct{}, n)
+	})
+}
+
+// MaxConcurrentBrotli returns an Option that limits the number of responses
+// encoded with brotli simultaneously to n, since brotli uses much more memory than gzip.
+// Responses beyond the limit are encoded with the next encoding the client accepts,
+// such as gzip, or are not encoded if there is no such encoding.
+func MaxConcurrentBrotli(n int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if n <= 0 {
+			panic(fmt.Errorf("httpenc: invalid max concurrent brotli encoders: %d", n))
+		}
+		opts.brotliSem = make(chan struct{}, n)
+	})
+}
+
+// EncoderMemoryLimit returns an Option that limits the total memory of encoders used
+// simultaneously to bytes, based on the estimate of the memory used by an encoder,
+// which depends on the encoding and the compression level.
+// A brotli encoder beyond the limit is replaced with the next encoding the client accepts,
+// such as gzip, and responses beyond the limit are not encoded if there is no such encoding.
+// It is combined with MaxConcurrentEncoders and MaxConcurrentBrotli.
+func EncoderMemoryLimit(bytes int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if bytes <= 0 {
+			panic(fmt.Errorf("httpenc: invalid encoder memory limit: %d", bytes))
+		}
+		opts.memoryBudget = &memoryBudget{limit: int64(bytes)}
+	})
+}
+
+// TranscodePrecompression returns an Option that transcodes precompression content
+// if the client does not accept its encoding but accepts another one.
+// The precompression content is decoded and encoded again on the fly.
+func TranscodePrecompression() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.transcodePrecompression = true
+	})
+}
+
+// NoCompressQueryParam returns an Option that disables encoding for requests
+// that have the query parameter name with an empty or true value, such as "?nocompress=1".
+// It is useful for debugging.
+func NoCompressQueryParam(name string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.noCompressQueryParam = name
+	})
+}
+
+// CompressEventStream returns an Option that enables encoding of server-sent events,
+// the responses with the Content-Type "text/event-stream".
+// By default, they are not encoded so that each event is delivered promptly.
+// If enabled, the handler must flush the response after each event.
+func CompressEventStream() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.compressEventStream = true
+	})
+}
+
+// PreferUncompressedSibling returns an Option that serves the uncompressed sibling of
+// precompression content in fsys, such as "/file.txt" for "/file.txt.gz", to a client that
+// does not accept the encoding of the precompression content, instead of decoding it.
+// The sibling is served with http.ServeContent, bypassing the next handler.
+// If the sibling does not exist, the precompression content is decoded as usual.
+func PreferUncompressedSibling(fsys http.FileSystem) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.uncompressedSiblingFS = fsys
+	})
+}
+
+// PrecompressedFile is a precompression file of a content.
+type PrecompressedFile struct {
+	// Path is the URL path of the precompression file.
+	Path string
+	// Encoding is the encoding of the precompression file.
+	Encoding EncodingType
+}
+
+// PrecompressionManifest returns an Option that sets the manifest of precompression files.
+// The manifest maps the URL path of a content to its precompression file.
+// A request for a path in the manifest is served with the precompression file,
+// which is decoded if the client does not accept its encoding.
+// The manifest is consulted before the detection by the extension.
+func PrecompressionManifest(manifest map[string]PrecompressedFile) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		for name, file := range manifest {
+			if !file.Encoding.IsValid() {
+				panic(fmt.Errorf("httpenc: invalid encoding of precompression file %q: %s", name, file.Encoding))
+			}
+		}
+		opts.precompressionManifest = manifest
+	})
+}
+
+// MinSize returns an Option that disables encoding of responses smaller than size bytes.
+// The content is held until its size reaches size bytes, or the response is finished.
+func MinSize(size int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if size < 0 {
+			panic(fmt.Errorf("httpenc: invalid min size: %d", size))
+		}
+		opts.minSize = size
+	})
+}
+
+// SkipContentTypes returns an Option that disables encoding of responses with
+// the media types, such as "image/png".
+// A type may be a wildcard pattern such as "image/*", or "*/*+json" matching
+// the structured syntax suffix.
+func SkipContentTypes(types ...string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if opts.skipContentTypes == nil {
+			opts.skipContentTypes = &contentTypeMatcher{}
+		}
+		for _, typ := range types {
+			opts.skipContentTypes.add(typ)
+		}
+	})
+}
+
+// CompressContentTypes returns an Option that enables encoding of responses with
+// the media types only, such as "text/html".
+// A type may be a wildcard pattern as in SkipContentTypes.
+// A response without the Content-Type header is still encoded.
+func CompressContentTypes(types ...string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if opts.compressContentTypes == nil {
+			opts.compressContentTypes = &contentTypeMatcher{}
+		}
+		for _, typ := range types {
+			opts.compressContentTypes.add(typ)
+		}
+	})
+}
+
+// RespectNoTransform returns an Option that disables encoding of responses with
+// the no-transform directive in the Cache-Control header.
+func RespectNoTransform() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.respectNoTransform = true
+	})
+}
+
+// smartMinSize is the minimum size set by SmartDefaults.
+const smartMinSize = 1024
+
+// compressibleContentTypes is the media types set by SmartDefaults.
+var compressibleContentTypes = []string{
+	"text/html",
+	"text/plain",
+	"text/css",
+	"text/csv",
+	"text/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/json",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	// The trailers of gRPC-Web are written in the body, so they are encoded with it.
+	"application/grpc-web",
+	"application/grpc-web+proto",
+	"application/grpc-web+json",
+	"application/grpc-web-text",
+	"application/grpc-web-text+proto",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+// SmartDefaults returns an Option that enables the options suitable for most servers at once.
+// It sets MinSize to 1024 bytes, CompressContentTypes to the common compressible media types,
+// and RespectNoTransform.
+func SmartDefaults() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		MinSize(smartMinSize).apply(opts)
+		CompressContentTypes(compressibleContentTypes...).apply(opts)
+		RespectNoTransform().apply(opts)
+	})
+}
+
+// Reasons passed to the function set by OnSkip.
+const (
+	// ReasonMethod means the request method is not supported.
+	ReasonMethod = "method"
+	// ReasonNotAccepted means the client accepts no available encodings.
+	ReasonNotAccepted = "not-accepted"
+	// ReasonUserAgent means the User-Agent is matched by SkipUserAgent.
+	ReasonUserAgent = "user-agent"
+	// ReasonQueryParam means the query parameter set by NoCompressQueryParam is present.
+	ReasonQueryParam = "query-param"
+	// ReasonFetchDest means the Sec-Fetch-Dest header is set by SkipByFetchDest.
+	ReasonFetchDest = "fetch-dest"
+	// ReasonStatus means the status code is not set by CompressStatuses, the response is
+	// a range response, such as 206 Partial Content, or the response has no content,
+	// such as 304 Not Modified.
+	ReasonStatus = "status"
+	// ReasonEventStream means the response is server-sent events.
+	ReasonEventStream = "event-stream"
+	// ReasonContentType means the content type is set by SkipContentTypes.
+	ReasonContentType = "content-type"
+	// ReasonNoTransform means the Cache-Control header of the response has the no-transform directive.
+	ReasonNoTransform = "no-transform"
+	// ReasonAttachment means the response is an attachment of an already compressed file.
+	ReasonAttachment = "attachment"
+	// ReasonMinSize means the content is smaller than the size set by MinSize.
+	ReasonMinSize = "min-size"
+	// ReasonEncoded means the content is already encoded by the handler.
+	ReasonEncoded = "encoded"
+	// ReasonDisabled means the handler disabled encoding.
+	ReasonDisabled = "disabled"
+	// ReasonConcurrency means the number of encoders reaches the limit set by MaxConcurrentEncoders,
+	// or the memory of encoders reaches the limit set by EncoderMemoryLimit.
+	ReasonConcurrency = "concurrency"
+	// ReasonEncoderError means the encoder could not be created.
+	ReasonEncoderError = "encoder-error"
+)
+
+// OnSkip returns an Option that sets the function called with the reason
+// whenever a response is not encoded. It is useful for debugging.
+func OnSkip(f func(reason string, r *http.Request)) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.onSkip = f
+	})
+}
+
+// SniffBeforeEncode returns an Option that holds the first 512 bytes of the content
+// if the handler does not set the Content-Type header, so that the content type is detected
+// from them before encoding, as net/http does for multiple small writes.
+// By default, the content type is detected from the content of the first write.
+func SniffBeforeEncode() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.sniffBeforeEncode = true
+	})
+}
+
+// BufferResponse returns an Option that holds the content up to maxBytes bytes until
+// the response is finished, so that the min size and the content type are decided
+// from the whole content, and the encoded content is sent with the Content-Length header.
+// If the content exceeds maxBytes, or the response is flushed, it is encoded on the fly.
+func BufferResponse(maxBytes int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if maxBytes <= 0 {
+			panic(fmt.Errorf("httpenc: invalid buffer size: %d", maxBytes))
+		}
+		opts.bufferResponse = maxBytes
+	})
+}
+
+// FlushOnNewline returns an Option that flushes the encoder and the underlying http.ResponseWriter
+// whenever the content written has a newline, so that each line of a streaming response,
+// such as newline-delimited JSON, is delivered promptly while it is still compressed.
+func FlushOnNewline() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.flushOnNewline = true
+	})
+}
+
+// OnError returns an Option that sets the function called when the handler can not proceed,
+// instead of the default behavior. f is responsible for writing the response.
+// It is called with ErrNotAcceptable when ValidatePrecompressAccept rejects a request,
+// instead of responding with 406 Not Acceptable, and with an *EncodeError when an encoder
+// can not be created, instead of sending the response without encoding.
+// In the latter case, the header set by the handler is kept, and the content is discarded.
+func OnError(f func(w http.ResponseWriter, r *http.Request, err error)) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.onError = f
+	})
+}
+
+// WriteBufferSize returns an Option that buffers the content of size bytes in front of
+// the encoder, which reduces the overhead of many small writes, such as by fmt.Fprintf
+// or template.Execute. The buffer is flushed when the response is flushed or finished.
+func WriteBufferSize(size int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if size < 0 {
+			panic(fmt.Errorf("httpenc: invalid write buffer size: %d", size))
+		}
+		opts.writeBufferSize = size
+	})
+}
+
+// SkipCompressedAttachments returns an Option that disables encoding of attachments
+// whose filename in the Content-Disposition header has the extension of an already
+// compressed file, such as ".zip" or ".gz".
+func SkipCompressedAttachments() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.skipCompressedAttachments = true
+	})
+}
+
+// DeterministicOutput returns an Option that makes the encoded output depend only on
+// the content, so that identical content yields identical bytes.
+// The brotli window size does not depend on the Content-Length header.
+// The gzip output is always deterministic, since its header has a zero modification time
+// and the unknown OS byte.
+func DeterministicOutput() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.deterministicOutput = true
+	})
+}
+
+// AssumeGzipIfAbsent returns an Option that assumes that the client accepts gzip
+// if the request has no Accept-Encoding header.
+// It is intended for controlled environments where every client is known to support gzip.
+func AssumeGzipIfAbsent() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.assumeGzip = true
+	})
+}
+
+// addTransformationWarning adds the transformation warning to header, unless it is already added.
+func addTransformationWarning(header http.Header) {
+	for _, v := range header.Values(warningHeader) {
+		if v == transformationWarning {
+			return
+		}
+	}
+	header.Add(warningHeader, transformationWarning)
+}
+
+// TransformationWarning returns an Option that adds the Warning header with
+// the warn-code 214 "Transformation Applied" to responses whose content is encoded
+// or decoded by the handler.
+func TransformationWarning() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.transformationWarning = true
+	})
+}
+
+// DisablePrecompression returns an Option that disables precompression content
+// by the extensions, such as ".gz" and ".br". Such files are served as opaque content,
+// which may be encoded on the fly like any other content.
+// Precompression content set by PrecompressionManifest is still served.
+func DisablePrecompression() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.disablePrecompression = true
+	})
+}
+
+// PrecompressionContentType returns an Option that sets the content type of
+// precompression content whose original file has no extension, such as "/data.gz".
+// By default, the content type of such content is "application/octet-stream".
+// It panics if contentType is not a valid media type.
+func PrecompressionContentType(contentType string) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			panic(fmt.Errorf("httpenc: invalid content type: %q", contentType))
+		}
+		opts.precompressionContentType = contentType
+	})
+}
+
+// DecodePipeBuffer returns an Option that buffers the content of n bytes handed to
+// the goroutine decoding precompression content, which reduces the context switches
+// for many small writes. The buffered content is decoded when the buffer is full
+// or the response is finished. By default, the content is not buffered.
+func DecodePipeBuffer(n int) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if n <= 0 {
+			panic(fmt.Errorf("httpenc: invalid decode pipe buffer size: %d", n))
+		}
+		opts.decodePipeBuffer = n
+	})
+}
+
+// OnDecodeStall returns an Option that sets the function called when writing
+// precompression content to be decoded blocks for threshold or longer,
+// which means the client is slow to receive the decoded content.
+// The function is called by a watchdog timer on another goroutine while the write is still blocked,
+// with the duration of the write so far, so a client stalled for good is reported as well.
+func OnDecodeStall(threshold time.Duration, f func(d time.Duration)) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		if threshold <= 0 {
+			panic(fmt.Errorf("httpenc: invalid decode stall threshold: %v", threshold))
+		}
+		opts.decodeStallThreshold = threshold
+		opts.onDecodeStall = f
+	})
+}
+
+// ConcurrentSafe returns an Option that serializes the Write, WriteHeader, Flush and Close
+// methods of the response writer, so that a handler can call them from multiple goroutines,
+// such as flushing server-sent events from another goroutine.
+// Without it, as with any http.ResponseWriter, the handler must serialize them.
+// The Header method is not serialized.
+func ConcurrentSafe() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.concurrentSafe = true
+	})
+}
+
+// WithNegotiator returns an Option that sets the negotiation strategy selecting the encoding of a response.
+// The negotiator is given the available encodings, including ones registered by CustomEncoder,
+// and an encoding it returns is ignored unless available. AssumeGzipIfAbsent, AssumeBrotliForUA and WithForcedEncoding
+// are not applied with a negotiator. If n is nil, the default strategy is used.
+func WithNegotiator(n Negotiator) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.negotiator = n
+	})
+}
+
+// StableSelection returns an Option that chooses the encoding of a response by the hash of a request,
+// among the acceptable encodings with the highest quality value, instead of the order of preference.
+// The same hash always yields the same encoding for the same Accept-Encoding header,
+// so hashing a client bucket, such as a cookie, keeps the variant stable for caches.
+// It is not applied with a negotiator set by WithNegotiator.
+func StableSelection(hash func(r *http.Request) uint64) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.stableSelection = hash
+	})
+}
+
+// DebugHeaders returns an Option that sets the X-Httpenc-Mode header telling how the response is handled:
+// "precompressed" if the precompression content is served as is, "encoded" if the content is encoded,
+// "decoded" if the precompression content is decoded, or "passthrough" otherwise.
+// It is intended for troubleshooting, and should not be used in production since it exposes internals.
+func DebugHeaders() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.debugHeaders = true
+	})
+}
+
+// DisableVary returns an Option that disables adding "Accept-Encoding" to the Vary header.
+// It is intended for deployments that serve a single variant. Without the Vary header,
+// a shared cache may serve an encoded response to a client that does not accept it.
+func DisableVary() Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.disableVary = true
+	})
+}
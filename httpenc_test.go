@@ -1,14 +1,36 @@
 package httpenc
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/andybalholm/brotli"
 )
@@ -143,6 +165,9 @@ func TestHandler(t *testing.T) {
 func decodeBody(b []byte, enc EncodingType) ([]byte, error) {
 	var r io.Reader
 	switch enc {
+	case "":
+		// not encoded
+		return b, nil
 	case Gzip:
 		gr, err := gzip.NewReader(bytes.NewReader(b))
 		if err != nil {
@@ -170,3 +195,5945 @@ func decodeBody(b []byte, enc EncodingType) ([]byte, error) {
 
 	return ret, nil
 }
+
+var validatePrecompressAcceptTests = map[string]struct {
+	path       string
+	accept     string
+	statusCode int
+}{
+	"no accept": {
+		path:       "/test1.txt.gz",
+		accept:     "",
+		statusCode: http.StatusOK,
+	},
+	"exact match": {
+		path:       "/test1.txt.gz",
+		accept:     "text/plain",
+		statusCode: http.StatusOK,
+	},
+	"type wildcard": {
+		path:       "/test1.txt.gz",
+		accept:     "text/*",
+		statusCode: http.StatusOK,
+	},
+	"wildcard": {
+		path:       "/test1.txt.gz",
+		accept:     "text/html, */*;q=0.1",
+		statusCode: http.StatusOK,
+	},
+	"mismatch": {
+		path:       "/test1.txt.gz",
+		accept:     "text/html",
+		statusCode: http.StatusNotAcceptable,
+	},
+	"excluded": {
+		path:       "/test1.txt.gz",
+		accept:     "text/html, text/plain;q=0",
+		statusCode: http.StatusNotAcceptable,
+	},
+}
+
+func TestValidatePrecompressAccept(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")), ValidatePrecompressAccept())
+
+	for name, tt := range validatePrecompressAcceptTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("status code is not match: got %d, want %d", rec.Code, tt.statusCode)
+			}
+			if vary := rec.Header().Values("Vary"); !reflect.DeepEqual(vary, []string{"Accept-Encoding", "Accept"}) {
+				t.Errorf("Vary is not match: got %#v, want %#v", vary, []string{"Accept-Encoding", "Accept"})
+			}
+		})
+	}
+}
+
+// verifyResponseWriter is an http.ResponseWriter that compares the written content
+// with the expected content without holding it.
+type verifyResponseWriter struct {
+	header   http.Header
+	expected []byte
+	offset   int
+	mismatch bool
+}
+
+func (w *verifyResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *verifyResponseWriter) Write(b []byte) (int, error) {
+	if w.offset+len(b) > len(w.expected) || !bytes.Equal(b, w.expected[w.offset:w.offset+len(b)]) {
+		w.mismatch = true
+	}
+	w.offset += len(b)
+	return len(b), nil
+}
+
+func (w *verifyResponseWriter) WriteHeader(statusCode int) {
+}
+
+func TestDecodeLargeWrite(t *testing.T) {
+	const size = 8 * 1024 * 1024
+
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatalf("gzip.Writer.Write(): error: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip.Writer.Close(): error: %v", err)
+	}
+	compressed := buf.Bytes()
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressed)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/large.bin.gz", nil)
+	w := &verifyResponseWriter{
+		header:   http.Header{},
+		expected: content,
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	h.ServeHTTP(w, req)
+
+	runtime.ReadMemStats(&after)
+
+	if w.mismatch || w.offset != len(content) {
+		t.Errorf("decoded content is not match: got %d bytes", w.offset)
+	}
+
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/8 {
+		t.Errorf("too many bytes allocated: got %d, want <= %d", alloc, size/8)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestCustomEncoder(t *testing.T) {
+	const token EncodingType = "Zstd"
+
+	h := Handler(http.FileServer(http.Dir("./testdata")), CustomEncoder(token, func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}))
+
+	for _, acceptEncoding := range []string{"Zstd", "zstd", "ZSTD, gzip;q=0.5"} {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test3.txt", nil)
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != string(token) {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, token)
+			}
+			if body := rec.Body.String(); body != "Test 3" {
+				t.Errorf("response body is not match: got %#v, want %#v", body, "Test 3")
+			}
+		})
+	}
+}
+
+func TestCustomEncoderDictionary(t *testing.T) {
+	const token EncodingType = "x-deflate-dict"
+	dict := []byte(`{"id": 0, "name": "", "email": "", "role": "member", "active": true, "created_at": "2022-01-01T00:00:00Z"}`)
+	content := []byte(`{"id": 42, "name": "gopher", "email": "gopher@example.com", "role": "member", "active": true, "created_at": "2022-03-04T05:06:07Z"}`)
+
+	serve := func(newEncoder EncoderFunc) []byte {
+		h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(content)
+		}), CustomEncoder(token, newEncoder))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", string(token))
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		if enc := rec.Header().Get("Content-Encoding"); enc != string(token) {
+			t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, token)
+		}
+		return rec.Body.Bytes()
+	}
+
+	withDict := serve(func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriterDict(w, flate.BestCompression, dict)
+	})
+	withoutDict := serve(func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, flate.BestCompression)
+	})
+
+	body, err := io.ReadAll(flate.NewReaderDict(bytes.NewReader(withDict), dict))
+	if err != nil {
+		t.Fatalf("io.ReadAll(): error: %v", err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("body is not match: got %#v, want %#v", string(body), string(content))
+	}
+	if len(withDict) >= len(withoutDict) {
+		t.Errorf("content with the dictionary is not smaller: got %d bytes, without the dictionary %d bytes", len(withDict), len(withoutDict))
+	}
+}
+
+var decodeHandlerTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	body            []byte
+}{
+	"precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		body:            []byte("Test 1"),
+	},
+	"decode precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		body:            []byte("Test 1"),
+	},
+	"no compression": {
+		path:            "/test3.txt",
+		acceptEncoding:  "gzip,deflate,br",
+		contentEncoding: "",
+		body:            []byte("Test 3"),
+	},
+}
+
+func TestDecodeHandler(t *testing.T) {
+	h := DecodeHandler(http.FileServer(http.Dir("./testdata")))
+
+	for name, tt := range decodeHandlerTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			bodyGot := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				bodyGot, err = decodeBody(bodyGot, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+
+			if !bytes.Equal(bodyGot, tt.body) {
+				t.Errorf("response body is not match: got %#v, want %#v", bodyGot, tt.body)
+			}
+		})
+	}
+}
+
+func TestEncodeError(t *testing.T) {
+	var writeErr error
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The decode error is reported by the Write following the corrupt content.
+		for i := 0; i < 2 && writeErr == nil; i++ {
+			_, writeErr = w.Write([]byte("this is not a gzip content"))
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/corrupt.txt.gz", nil)
+	rec := httptest.NewRecorder()
+
+	if !serveAborted(h, rec, req) {
+		t.Error("response is not aborted")
+	}
+
+	var encErr *EncodeError
+	if !errors.As(writeErr, &encErr) {
+		t.Fatalf("errors.As(): error is not *EncodeError: %v", writeErr)
+	}
+	if encErr.Encoding != Gzip {
+		t.Errorf("Encoding is not match: got %#v, want %#v", encErr.Encoding, Gzip)
+	}
+	if encErr.Op != "decode" {
+		t.Errorf("Op is not match: got %#v, want %#v", encErr.Op, "decode")
+	}
+	if !errors.Is(writeErr, gzip.ErrHeader) {
+		t.Errorf("errors.Is(): error is not gzip.ErrHeader: %v", writeErr)
+	}
+}
+
+// serveAborted calls h.ServeHTTP, and reports whether h aborts the response by panicking with http.ErrAbortHandler.
+func serveAborted(h http.Handler, w http.ResponseWriter, r *http.Request) (aborted bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				panic(p)
+			}
+			aborted = true
+		}
+	}()
+	h.ServeHTTP(w, r)
+	return false
+}
+
+var negotiateEncodingTests = map[string]struct {
+	acceptEncoding string
+	encoding       EncodingType
+	ok             bool
+}{
+	"no header": {
+		acceptEncoding: "",
+		ok:             false,
+	},
+	"x-brotli": {
+		acceptEncoding: "x-brotli",
+		encoding:       Brotli,
+		ok:             true,
+	},
+	"x-gzip": {
+		acceptEncoding: "X-Gzip",
+		encoding:       Gzip,
+		ok:             true,
+	},
+	"x-brotli q=0 and wildcard": {
+		acceptEncoding: "x-brotli;q=0, *",
+		encoding:       Gzip,
+		ok:             true,
+	},
+	"client order": {
+		acceptEncoding: "deflate, gzip, br",
+		encoding:       Deflate,
+		ok:             true,
+	},
+	"quality": {
+		acceptEncoding: "gzip;q=0.5, br;q=0.8",
+		encoding:       Brotli,
+		ok:             true,
+	},
+	"case insensitive": {
+		acceptEncoding: "GZIP",
+		encoding:       Gzip,
+		ok:             true,
+	},
+	"excluded": {
+		acceptEncoding: "gzip;q=0",
+		ok:             false,
+	},
+	"wildcard": {
+		acceptEncoding: "*",
+		encoding:       Brotli,
+		ok:             true,
+	},
+	"excluded wildcard": {
+		acceptEncoding: "*;q=0",
+		ok:             false,
+	},
+	"exclusion then wildcard": {
+		acceptEncoding: "gzip;q=0, *;q=1",
+		encoding:       Brotli,
+		ok:             true,
+	},
+	"wildcard then exclusion": {
+		acceptEncoding: "*;q=1, gzip;q=0",
+		encoding:       Brotli,
+		ok:             true,
+	},
+	"exclusions then wildcard": {
+		acceptEncoding: "br;q=0, gzip;q=0, *",
+		encoding:       Deflate,
+		ok:             true,
+	},
+	"listed with lower quality than wildcard": {
+		acceptEncoding: "br;q=0.1, *",
+		encoding:       Gzip,
+		ok:             true,
+	},
+	"unsupported": {
+		acceptEncoding: "compress, identity",
+		ok:             false,
+	},
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	available := []EncodingType{Brotli, Gzip, Deflate}
+
+	for name, tt := range negotiateEncodingTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			enc, ok := NegotiateEncoding(req, available)
+			if ok != tt.ok {
+				t.Fatalf("NegotiateEncoding(): ok is not match: got %v, want %v", ok, tt.ok)
+			}
+			if enc != tt.encoding {
+				t.Errorf("NegotiateEncoding(): encoding is not match: got %#v, want %#v", enc, tt.encoding)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncodingMultipleHeaders(t *testing.T) {
+	available := []EncodingType{Brotli, Gzip, Deflate}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept-Encoding", "gzip;q=0.5")
+	req.Header.Add("Accept-Encoding", "br;q=0.8, deflate;q=0.1")
+
+	enc, ok := NegotiateEncoding(req, available)
+	if !ok || enc != Brotli {
+		t.Errorf("NegotiateEncoding(): got (%#v, %v), want (%#v, %v)", enc, ok, Brotli, true)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept-Encoding", "*")
+	req.Header.Add("Accept-Encoding", "br;q=0")
+
+	enc, ok = NegotiateEncoding(req, available)
+	if !ok || enc != Gzip {
+		t.Errorf("NegotiateEncoding(): got (%#v, %v), want (%#v, %v)", enc, ok, Gzip, true)
+	}
+
+	// Empty list elements are ignored.
+	for _, values := range [][]string{
+		{"", "gzip"},
+		{"gzip,"},
+		{" , gzip", " "},
+	} {
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, v := range values {
+			req.Header.Add("Accept-Encoding", v)
+		}
+
+		enc, ok = NegotiateEncoding(req, available)
+		if !ok || enc != Gzip {
+			t.Errorf("NegotiateEncoding(%#v): got (%#v, %v), want (%#v, %v)", values, enc, ok, Gzip, true)
+		}
+	}
+}
+
+func TestHandlerExclusionThenWildcard(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")))
+
+	for _, acceptEncoding := range []string{"gzip;q=0, *;q=1", "*;q=1, gzip;q=0"} {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test3.txt", nil)
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != string(Brotli) {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, Brotli)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Brotli)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if string(body) != "Test 3" {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), "Test 3")
+			}
+		})
+	}
+}
+
+var httpErrorTests = map[string]struct {
+	opts            []Option
+	contentEncoding string
+}{
+	"compressed": {
+		opts:            nil,
+		contentEncoding: "gzip",
+	},
+	"compressed status": {
+		opts:            []Option{CompressStatuses(http.StatusOK, http.StatusInternalServerError)},
+		contentEncoding: "gzip",
+	},
+	"uncompressed status": {
+		opts:            []Option{CompressStatuses(http.StatusOK)},
+		contentEncoding: "",
+	},
+}
+
+func TestHTTPError(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	for name, tt := range httpErrorTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(next, tt.opts...)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("status code is not match: got %d, want %d", rec.Code, http.StatusInternalServerError)
+			}
+			if typ := rec.Header().Get("Content-Type"); typ != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, "text/plain; charset=utf-8")
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != "boom\n" {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), "boom\n")
+			}
+		})
+	}
+}
+
+var headTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	contentLength   int64
+}{
+	"compression": {
+		path:            "/test3.txt",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentLength:   -1,
+	},
+	"no compression": {
+		path:            "/test3.txt",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		contentLength:   int64(len("Test 3")),
+	},
+	"precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		// the length of the precompression content is known.
+		contentLength: 36,
+	},
+}
+
+func TestHead(t *testing.T) {
+	server := httptest.NewServer(Handler(http.FileServer(http.Dir("./testdata"))))
+	defer server.Close()
+
+	for name, tt := range headTests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodHead, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Head: error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("invalid status: %s", resp.Status)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if resp.ContentLength != tt.contentLength {
+				t.Errorf("Content-Length is not match: got %d, want %d", resp.ContentLength, tt.contentLength)
+			}
+		})
+	}
+}
+
+var headGetHeaderTests = map[string]struct {
+	options         []Option
+	contentEncoding string
+}{
+	"compression": {
+		contentEncoding: "gzip",
+	},
+	"min size": {
+		options:         []Option{MinSize(100)},
+		contentEncoding: "",
+	},
+}
+
+func TestHeadGetHeader(t *testing.T) {
+	for name, tt := range headGetHeaderTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.options...)
+
+			headers := map[string]http.Header{}
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				req := httptest.NewRequest(method, "/test3.txt", nil)
+				req.Header.Set("Accept-Encoding", "gzip")
+				rec := httptest.NewRecorder()
+
+				h.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status code is not match: got %d, want %d", method, rec.Code, http.StatusOK)
+				}
+				headers[method] = rec.Header()
+			}
+
+			get, head := headers[http.MethodGet], headers[http.MethodHead]
+			if enc := head.Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if !reflect.DeepEqual(head, get) {
+				t.Errorf("HEAD header is not match: got %#v, want %#v", head, get)
+			}
+		})
+	}
+}
+
+func TestOptionsFlush(t *testing.T) {
+	const body = "preflight"
+
+	read := make(chan struct{}, 1)
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+		w.(http.Flusher).Flush()
+
+		// Keep the response open until the client has read the flushed content.
+		select {
+		case <-read:
+		case <-time.After(5 * time.Second):
+		}
+	})))
+	defer server.Close()
+
+	for _, enc := range []EncodingType{Gzip, Deflate, Brotli} {
+		t.Run(string(enc), func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodOptions, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", string(enc))
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Options: error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Encoding"); got != string(enc) {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", got, enc)
+			}
+
+			r, err := newDecodeReader(resp.Body, enc)
+			if err != nil {
+				t.Fatalf("newDecodeReader(): error: %v", err)
+			}
+
+			got := make([]byte, len(body))
+			_, err = io.ReadFull(r, got)
+			read <- struct{}{}
+			if err != nil {
+				t.Fatalf("io.ReadFull(): error: %v", err)
+			}
+			if string(got) != body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(got), body)
+			}
+		})
+	}
+}
+
+func newDecodeReader(r io.Reader, enc EncodingType) (io.Reader, error) {
+	switch enc {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Deflate:
+		return zlib.NewReader(r)
+	case Brotli:
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding: %s", enc)
+}
+
+func TestLevels(t *testing.T) {
+	options := newHandler(http.NotFoundHandler(), true, []Option{Levels(gzip.BestSpeed, zlib.BestCompression, brotli.BestSpeed)}).options
+
+	if options.gzipLevel != gzip.BestSpeed {
+		t.Errorf("gzip level is not match: got %d, want %d", options.gzipLevel, gzip.BestSpeed)
+	}
+	if options.deflateLevel != zlib.BestCompression {
+		t.Errorf("deflate level is not match: got %d, want %d", options.deflateLevel, zlib.BestCompression)
+	}
+	if options.brotliLevel != brotli.BestSpeed {
+		t.Errorf("brotli level is not match: got %d, want %d", options.brotliLevel, brotli.BestSpeed)
+	}
+}
+
+func TestLevelsInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Levels(): must panic with an invalid level")
+		}
+	}()
+
+	newHandler(http.NotFoundHandler(), true, []Option{Levels(gzip.BestSpeed, zlib.BestCompression, 100)})
+}
+
+var levelBoundaryTests = map[string]struct {
+	enc   EncodingType
+	level int
+	valid bool
+}{
+	"gzip below HuffmanOnly":     {enc: Gzip, level: gzip.HuffmanOnly - 1, valid: false},
+	"gzip HuffmanOnly":           {enc: Gzip, level: gzip.HuffmanOnly, valid: true},
+	"gzip DefaultCompression":    {enc: Gzip, level: gzip.DefaultCompression, valid: true},
+	"gzip NoCompression":         {enc: Gzip, level: gzip.NoCompression, valid: true},
+	"gzip BestSpeed":             {enc: Gzip, level: gzip.BestSpeed, valid: true},
+	"gzip BestCompression":       {enc: Gzip, level: gzip.BestCompression, valid: true},
+	"gzip above BestCompression": {enc: Gzip, level: gzip.BestCompression + 1, valid: false},
+
+	"deflate below HuffmanOnly":     {enc: Deflate, level: zlib.HuffmanOnly - 1, valid: false},
+	"deflate HuffmanOnly":           {enc: Deflate, level: zlib.HuffmanOnly, valid: true},
+	"deflate DefaultCompression":    {enc: Deflate, level: zlib.DefaultCompression, valid: true},
+	"deflate NoCompression":         {enc: Deflate, level: zlib.NoCompression, valid: true},
+	"deflate BestSpeed":             {enc: Deflate, level: zlib.BestSpeed, valid: true},
+	"deflate BestCompression":       {enc: Deflate, level: zlib.BestCompression, valid: true},
+	"deflate above BestCompression": {enc: Deflate, level: zlib.BestCompression + 1, valid: false},
+
+	"brotli below BestSpeed":       {enc: Brotli, level: brotli.BestSpeed - 1, valid: false},
+	"brotli BestSpeed":             {enc: Brotli, level: brotli.BestSpeed, valid: true},
+	"brotli DefaultCompression":    {enc: Brotli, level: brotli.DefaultCompression, valid: true},
+	"brotli BestCompression":       {enc: Brotli, level: brotli.BestCompression, valid: true},
+	"brotli above BestCompression": {enc: Brotli, level: brotli.BestCompression + 1, valid: false},
+}
+
+func TestLevelBoundaries(t *testing.T) {
+	// The named constants are pinned, so that a change of the libraries is noticed.
+	for name, tt := range map[string]struct{ got, want int }{
+		"gzip.HuffmanOnly":          {got: gzip.HuffmanOnly, want: -2},
+		"gzip.BestCompression":      {got: gzip.BestCompression, want: 9},
+		"zlib.HuffmanOnly":          {got: zlib.HuffmanOnly, want: -2},
+		"zlib.BestCompression":      {got: zlib.BestCompression, want: 9},
+		"brotli.BestSpeed":          {got: brotli.BestSpeed, want: 0},
+		"brotli.DefaultCompression": {got: brotli.DefaultCompression, want: 6},
+		"brotli.BestCompression":    {got: brotli.BestCompression, want: 11},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s is not match: got %d, want %d", name, tt.got, tt.want)
+		}
+	}
+
+	newOption := map[EncodingType]func(level int) Option{
+		Gzip:    GzipLevel,
+		Deflate: DeflateLevel,
+		Brotli:  BrotliLevel,
+	}
+
+	for name, tt := range levelBoundaryTests {
+		t.Run(name, func(t *testing.T) {
+			func() {
+				defer func() {
+					if r := recover(); (r == nil) != tt.valid {
+						t.Errorf("option panic is not match: got %v, want valid %v", r, tt.valid)
+					}
+				}()
+				newHandler(http.NotFoundHandler(), true, []Option{newOption[tt.enc](tt.level)})
+			}()
+
+			// The level accepted by the option must be accepted by the library.
+			w, err := NewEncoder(io.Discard, tt.enc, tt.level)
+			if (err == nil) != tt.valid {
+				t.Fatalf("NewEncoder(): error is not match: got %v, want valid %v", err, tt.valid)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := w.Write([]byte("Test data")); err != nil {
+				t.Errorf("Write(): error: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Errorf("Close(): error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNilHandler(t *testing.T) {
+	for name, newHandler := range map[string]func(http.Handler, ...Option) http.Handler{
+		"Handler":       Handler,
+		"DecodeHandler": DecodeHandler,
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				err, ok := recover().(error)
+				if !ok || err.Error() != "httpenc: nil handler" {
+					t.Errorf("%s(): panic is not match: got %v, want %v", name, err, "httpenc: nil handler")
+				}
+			}()
+
+			newHandler(nil)
+		})
+	}
+}
+
+func TestPrecompressionConcurrent(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, acceptEncoding := range []string{"gzip", ""} {
+			wg.Add(1)
+			go func(acceptEncoding string) {
+				defer wg.Done()
+
+				req := httptest.NewRequest(http.MethodGet, "/test1.txt.gz", nil)
+				if acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", acceptEncoding)
+				}
+				rec := httptest.NewRecorder()
+
+				h.ServeHTTP(rec, req)
+
+				// modify the response headers to detect sharing by the race detector.
+				rec.Header().Set("Content-Type", "text/html")
+				rec.Header().Add("Content-Encoding", "identity")
+
+				if rec.Code != http.StatusOK {
+					t.Errorf("invalid status: %d", rec.Code)
+				}
+			}(acceptEncoding)
+		}
+	}
+	wg.Wait()
+}
+
+var svgzTests = map[string]struct {
+	acceptEncoding  string
+	contentEncoding string
+}{
+	"precompression": {
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+	},
+	"decode precompression": {
+		acceptEncoding:  "",
+		contentEncoding: "",
+	},
+	"not accepted": {
+		acceptEncoding:  "br",
+		contentEncoding: "",
+	},
+}
+
+func TestSVGZ(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="1" height="1"></svg>` + "\n"
+
+	h := Handler(http.FileServer(http.Dir("./testdata")))
+
+	for name, tt := range svgzTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/image.svgz", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if typ := rec.Header().Get("Content-Type"); typ != "image/svg+xml" {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, "image/svg+xml")
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != svg {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), svg)
+			}
+		})
+	}
+}
+
+var notFoundTests = map[string]struct {
+	opts            []Option
+	contentEncoding string
+}{
+	"compressed": {
+		opts:            []Option{CompressStatuses(http.StatusOK, http.StatusNotFound)},
+		contentEncoding: "gzip",
+	},
+	"uncompressed": {
+		opts:            []Option{CompressStatuses(http.StatusOK)},
+		contentEncoding: "",
+	},
+}
+
+func TestNotFound(t *testing.T) {
+	for name, tt := range notFoundTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.opts...)
+
+			req := httptest.NewRequest(http.MethodGet, "/missing.txt", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status code is not match: got %d, want %d", rec.Code, http.StatusNotFound)
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != "404 page not found\n" {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), "404 page not found\n")
+			}
+		})
+	}
+}
+
+// countResponseWriter is an http.ResponseWriter that counts and discards the written content.
+type countResponseWriter struct {
+	header http.Header
+	n      int64
+}
+
+func (w *countResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *countResponseWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func (w *countResponseWriter) WriteHeader(statusCode int) {
+}
+
+// benchmarkText returns a representative text content of size bytes.
+func benchmarkText(size int) []byte {
+	words := []string{
+		"the", "quick", "brown", "fox", "jumps", "over", "lazy", "dog",
+		"http", "response", "content", "encoding", "compression", "handler",
+		"{", "}", "\"id\":", "\"name\":", "<div>", "</div>", "\n",
+	}
+	r := rand.New(rand.NewSource(1))
+
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		buf.WriteString(words[r.Intn(len(words))])
+		buf.WriteByte(' ')
+	}
+	return buf.Bytes()[:size]
+}
+
+func BenchmarkHandler(b *testing.B) {
+	levels := []struct {
+		enc    EncodingType
+		name   string
+		option Option
+	}{
+		{Gzip, "BestSpeed", GzipLevel(gzip.BestSpeed)},
+		{Gzip, "Default", GzipLevel(gzip.DefaultCompression)},
+		{Gzip, "BestCompression", GzipLevel(gzip.BestCompression)},
+		{Deflate, "BestSpeed", DeflateLevel(zlib.BestSpeed)},
+		{Deflate, "Default", DeflateLevel(zlib.DefaultCompression)},
+		{Deflate, "BestCompression", DeflateLevel(zlib.BestCompression)},
+		{Brotli, "BestSpeed", BrotliLevel(brotli.BestSpeed)},
+		{Brotli, "Default", BrotliLevel(brotli.DefaultCompression)},
+		{Brotli, "BestCompression", BrotliLevel(brotli.BestCompression)},
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"256B", 256},
+		{"4KB", 4 * 1024},
+		{"64KB", 64 * 1024},
+		{"1MB", 1024 * 1024},
+	}
+
+	for _, level := range levels {
+		for _, size := range sizes {
+			content := benchmarkText(size.size)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			}), level.option)
+
+			b.Run(fmt.Sprintf("%s/%s/%s", level.enc, level.name, size.name), func(b *testing.B) {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", string(level.enc))
+
+				b.SetBytes(int64(len(content)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				var out int64
+				for i := 0; i < b.N; i++ {
+					w := &countResponseWriter{header: http.Header{}}
+					h.ServeHTTP(w, req)
+					out = w.n
+				}
+
+				b.ReportMetric(float64(out), "bytes-out")
+			})
+		}
+	}
+}
+
+var corruptPrecompressionTests = map[string]struct {
+	next http.Handler
+	// aborted is true if the response is aborted by the error of decoding.
+	aborted bool
+}{
+	"file server": {
+		next: http.FileServer(http.FS(fstest.MapFS{
+			"corrupt.txt.gz": &fstest.MapFile{Data: []byte("this is not a gzip content")},
+		})),
+		aborted: true,
+	},
+	"write": {
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte("this is not a gzip content"))
+		}),
+		aborted: true,
+	},
+	"no write": {
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+		}),
+		aborted: false,
+	},
+}
+
+func TestCorruptPrecompression(t *testing.T) {
+	for name, tt := range corruptPrecompressionTests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(Handler(tt.next))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/corrupt.txt.gz", nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err == nil {
+				defer resp.Body.Close()
+				_, err = io.Copy(io.Discard, resp.Body)
+
+				if enc, ok := resp.Header["Content-Encoding"]; ok {
+					t.Errorf("Content-Encoding must not be set: got %#v", enc)
+				}
+			}
+			if aborted := err != nil; aborted != tt.aborted {
+				t.Errorf("aborted is not match: got %#v, want %#v: %v", aborted, tt.aborted, err)
+			}
+		})
+	}
+}
+
+// encodeTestContent returns content encoded with enc.
+func encodeTestContent(t testing.TB, enc EncodingType, content []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Deflate:
+		w = zlib.NewWriter(&buf)
+	case Brotli:
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unsupported encoding: %s", enc)
+	}
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close(): error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+var truncatedPrecompressionTests = map[string]struct {
+	// size is the size of the truncated precompression file relative to the whole file.
+	size    float64
+	aborted bool
+}{
+	"whole":          {size: 1, aborted: false},
+	"half":           {size: 0.5, aborted: true},
+	"trailer":        {size: 0.999, aborted: true},
+	"small fraction": {size: 0.01, aborted: true},
+}
+
+func TestTruncatedPrecompression(t *testing.T) {
+	// The encoded content is larger than a write of http.FileServer,
+	// so that a large file is decoded in the goroutine.
+	content := benchmarkText(512 * 1024)
+	exts := map[EncodingType]string{Gzip: ".gz", Brotli: ".br", Deflate: ".zz"}
+
+	for _, enc := range []EncodingType{Gzip, Brotli, Deflate} {
+		data := encodeTestContent(t, enc, content)
+		for name, tt := range truncatedPrecompressionTests {
+			t.Run(string(enc)+"/"+name, func(t *testing.T) {
+				size := int(float64(len(data)) * tt.size)
+				fsys := fstest.MapFS{
+					"data.txt" + exts[enc]: &fstest.MapFile{Data: data[:size]},
+				}
+				server := httptest.NewServer(Handler(http.FileServer(http.FS(fsys)), PrecompressionManifest(map[string]PrecompressedFile{
+					"/data.txt": {Path: "/data.txt" + exts[enc], Encoding: enc},
+				})))
+				defer server.Close()
+
+				client := &http.Client{
+					Transport: &http.Transport{DisableCompression: true},
+					Timeout:   10 * time.Second,
+				}
+				resp, err := client.Get(server.URL + "/data.txt")
+				var body []byte
+				if err == nil {
+					defer resp.Body.Close()
+					body, err = io.ReadAll(resp.Body)
+				}
+				if errors.Is(err, context.DeadlineExceeded) || os.IsTimeout(err) {
+					t.Fatalf("response is not completed: %v", err)
+				}
+
+				if aborted := err != nil; aborted != tt.aborted {
+					t.Fatalf("aborted is not match: got %#v, want %#v: %v", aborted, tt.aborted, err)
+				}
+				if !bytes.HasPrefix(content, body) {
+					t.Errorf("body is not a prefix of the content: %d bytes", len(body))
+				}
+				if !tt.aborted && len(body) != len(content) {
+					t.Errorf("body length is not match: got %#v, want %#v", len(body), len(content))
+				}
+			})
+		}
+	}
+}
+
+func TestTruncatedPrecompressionPanic(t *testing.T) {
+	data := encodeTestContent(t, Gzip, benchmarkText(1024))
+	errPanic := errors.New("handler panic")
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(data[:len(data)/2])
+		panic(errPanic)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/data.txt.gz", nil)
+	rec := httptest.NewRecorder()
+
+	defer func() {
+		// The panic of the handler must not be replaced by http.ErrAbortHandler.
+		if p := recover(); p != errPanic {
+			t.Errorf("recover() is not match: got %#v, want %#v", p, errPanic)
+		}
+	}()
+	h.ServeHTTP(rec, req)
+}
+
+func FuzzDecodeTruncated(f *testing.F) {
+	f.Add(uint8(0), uint16(10), uint16(1024), false)
+	f.Add(uint8(1), uint16(100), uint16(7), false)
+	f.Add(uint8(2), uint16(1000), uint16(1000), true)
+	f.Add(uint8(0), uint16(65535), uint16(65535), true)
+
+	content := benchmarkText(16 * 1024)
+	encs := []EncodingType{Gzip, Brotli, Deflate}
+	encoded := make([][]byte, len(encs))
+	for i, enc := range encs {
+		encoded[i] = encodeTestContent(f, enc, content)
+	}
+
+	f.Fuzz(func(t *testing.T, encIndex uint8, size uint16, chunkSize uint16, sized bool) {
+		i := int(encIndex) % len(encs)
+		data := encoded[i]
+		if int(size) < len(data) {
+			data = data[:size]
+		}
+		if chunkSize == 0 {
+			chunkSize = 1
+		}
+
+		rec := httptest.NewRecorder()
+		header := http.Header{}
+		if sized {
+			// The whole content is decoded synchronously if it is written at once.
+			header.Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		dw := newDecodeResonseWriter(rec, encs[i], header, &handlerOptions{})
+
+		var writeErr error
+		for b := data; len(b) > 0 && writeErr == nil; {
+			n := int(chunkSize)
+			if n > len(b) {
+				n = len(b)
+			}
+			_, writeErr = dw.Write(b[:n])
+			b = b[n:]
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- dw.Close()
+		}()
+		var closeErr error
+		select {
+		case closeErr = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("decodeResponseWriter.Close() is deadlocked")
+		}
+
+		body := rec.Body.Bytes()
+		if !bytes.HasPrefix(content, body) {
+			t.Fatalf("body is not a prefix of the content: %d bytes", len(body))
+		}
+		truncated := len(data) < len(encoded[i])
+		if truncated && len(data) > 0 && closeErr == nil {
+			t.Errorf("decodeResponseWriter.Close(): error is not reported for %d of %d bytes: write error: %v", len(data), len(encoded[i]), writeErr)
+		}
+		if !truncated && (writeErr != nil || closeErr != nil) {
+			t.Errorf("decode error: write error: %v, close error: %v", writeErr, closeErr)
+		}
+		if !truncated && !bytes.Equal(body, content) {
+			t.Errorf("body length is not match: got %#v, want %#v", len(body), len(content))
+		}
+	})
+}
+
+var skipUserAgentTests = map[string]struct {
+	path            string
+	userAgent       string
+	contentEncoding string
+	body            string
+}{
+	"matched": {
+		path:            "/test3.txt",
+		userAgent:       "LegacyBrowser/1.0",
+		contentEncoding: "",
+		body:            "Test 3",
+	},
+	"not matched": {
+		path:            "/test3.txt",
+		userAgent:       "ModernBrowser/1.0",
+		contentEncoding: "gzip",
+		body:            "Test 3",
+	},
+	"matched precompression": {
+		path:            "/test1.txt.gz",
+		userAgent:       "LegacyBrowser/1.0",
+		contentEncoding: "",
+		body:            "Test 1",
+	},
+}
+
+func TestSkipUserAgent(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")), SkipUserAgent(func(ua string) bool {
+		return strings.HasPrefix(ua, "LegacyBrowser/")
+	}))
+
+	for name, tt := range skipUserAgentTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("User-Agent", tt.userAgent)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+func TestFlushWrite(t *testing.T) {
+	chunks := []string{"first chunk\n", "second chunk\n", strings.Repeat("third chunk\n", 1000)}
+
+	for _, enc := range []EncodingType{Gzip, Deflate, Brotli} {
+		t.Run(string(enc), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var written string
+				for _, chunk := range chunks {
+					w.Write([]byte(chunk))
+					w.(http.Flusher).Flush()
+					written += chunk
+
+					// All of the content written so far must be decodable after Flush.
+					dr, err := newDecodeReader(bytes.NewReader(rec.Body.Bytes()), enc)
+					if err != nil {
+						t.Fatalf("newDecodeReader(): error: %v", err)
+					}
+					got := make([]byte, len(written))
+					if _, err := io.ReadFull(dr, got); err != nil {
+						t.Fatalf("io.ReadFull(): error: %v", err)
+					}
+					if string(got) != written {
+						t.Fatalf("flushed content is not match: got %#v, want %#v", string(got), written)
+					}
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", string(enc))
+
+			h.ServeHTTP(rec, req)
+
+			if !rec.Flushed {
+				t.Error("response is not flushed")
+			}
+
+			body, err := decodeBody(rec.Body.Bytes(), enc)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if want := strings.Join(chunks, ""); string(body) != want {
+				t.Errorf("response body is not match: got %d bytes, want %d bytes", len(body), len(want))
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentEncoders(t *testing.T) {
+	const (
+		limit    = 2
+		requests = 5
+	)
+
+	started := make(chan struct{}, requests)
+	release := make(chan struct{})
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+		started <- struct{}{}
+		<-release
+	}), MaxConcurrentEncoders(limit))
+
+	recs := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			h.ServeHTTP(rec, req)
+		}(recs[i])
+	}
+	for range recs {
+		<-started
+	}
+	close(release)
+	wg.Wait()
+
+	var encoded int
+	for _, rec := range recs {
+		body := rec.Body.Bytes()
+		if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+			encoded++
+			var err error
+			body, err = decodeBody(body, EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+		}
+		if string(body) != "content" {
+			t.Errorf("response body is not match: got %#v, want %#v", string(body), "content")
+		}
+	}
+	if encoded != limit {
+		t.Errorf("number of encoded responses is not match: got %d, want %d", encoded, limit)
+	}
+
+	// The semaphore is released after the responses.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+	}
+}
+
+func TestMaxConcurrentBrotli(t *testing.T) {
+	const (
+		limit    = 2
+		requests = 5
+	)
+
+	started := make(chan struct{}, requests+2)
+	release := make(chan struct{})
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+		started <- struct{}{}
+		<-release
+	}), MaxConcurrentBrotli(limit))
+
+	serve := func(rec *httptest.ResponseRecorder, acceptEncoding string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(rec, req)
+	}
+
+	recs := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			serve(rec, "br, gzip")
+		}(recs[i])
+	}
+	for range recs {
+		<-started
+	}
+
+	// The client that accepts only brotli gets the content without encoding.
+	brOnly := httptest.NewRecorder()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve(brOnly, "br")
+	}()
+	<-started
+
+	close(release)
+	wg.Wait()
+
+	counts := map[string]int{}
+	for _, rec := range recs {
+		enc := rec.Header().Get("Content-Encoding")
+		counts[enc]++
+		body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+		if err != nil {
+			t.Fatalf("decodeBody(): %v", err)
+		}
+		if string(body) != "content" {
+			t.Errorf("response body is not match: got %#v, want %#v", string(body), "content")
+		}
+	}
+	want := map[string]int{"br": limit, "gzip": requests - limit}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("number of encoded responses is not match: got %v, want %v", counts, want)
+	}
+	if enc := brOnly.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+
+	// The semaphore is released after the responses.
+	rec := httptest.NewRecorder()
+	serve(rec, "br, gzip")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "br" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "br")
+	}
+}
+
+func TestNestedHandler(t *testing.T) {
+	fs := http.FileServer(http.Dir("./testdata"))
+
+	tests := map[string]struct {
+		h    http.Handler
+		path string
+		body string
+	}{
+		"handler":                {Handler(Handler(fs)), "/test3.txt", "Test 3"},
+		"handler precompression": {Handler(Handler(fs)), "/test1.txt.gz", "Test 1"},
+		"file handler":           {Handler(FileHandler("./testdata")), "/test1.txt", "Test 1"},
+		"decode handler":         {DecodeHandler(Handler(fs)), "/test3.txt", "Test 3"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			tt.h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Values("Content-Encoding"); len(enc) != 1 || enc[0] != "gzip" {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, []string{"gzip"})
+			}
+			if typ := rec.Header().Get("Content-Type"); !strings.HasPrefix(typ, "text/plain") {
+				t.Errorf("Content-Type is not match: got %#v", typ)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Gzip)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+var transcodePrecompressionTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	body            string
+}{
+	"transcode gzip": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "br",
+		contentEncoding: "br",
+		body:            "Test 1",
+	},
+	"transcode brotli": {
+		path:            "/test2.txt.br",
+		acceptEncoding:  "deflate",
+		contentEncoding: "deflate",
+		body:            "Test 2",
+	},
+	"precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "br, gzip",
+		contentEncoding: "gzip",
+		body:            "Test 1",
+	},
+	"decode": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		body:            "Test 1",
+	},
+}
+
+func TestTranscodePrecompression(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")), TranscodePrecompression())
+
+	for name, tt := range transcodePrecompressionTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if typ := rec.Header().Get("Content-Type"); typ != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, "text/plain; charset=utf-8")
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+var noCompressQueryParamTests = map[string]struct {
+	query           string
+	contentEncoding string
+}{
+	"truthy": {
+		query:           "?nocompress=1",
+		contentEncoding: "",
+	},
+	"true": {
+		query:           "?nocompress=true",
+		contentEncoding: "",
+	},
+	"empty": {
+		query:           "?nocompress",
+		contentEncoding: "",
+	},
+	"falsy": {
+		query:           "?nocompress=0",
+		contentEncoding: "gzip",
+	},
+	"absent": {
+		query:           "?other=1",
+		contentEncoding: "gzip",
+	},
+}
+
+func TestNoCompressQueryParam(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")), NoCompressQueryParam("nocompress"))
+
+	for name, tt := range noCompressQueryParamTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test3.txt"+tt.query, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != "Test 3" {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), "Test 3")
+			}
+		})
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	events := []string{
+		"event: message\ndata: first\n\n",
+		"event: message\ndata: second\n\n",
+		"event: message\ndata: third\n\n",
+	}
+
+	tests := map[string]struct {
+		opts            []Option
+		contentEncoding string
+	}{
+		"default": {
+			opts:            nil,
+			contentEncoding: "",
+		},
+		"compress": {
+			opts:            []Option{CompressEventStream()},
+			contentEncoding: "gzip",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			read := make(chan struct{}, 1)
+			server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				for _, event := range events {
+					w.Write([]byte(event))
+					w.(http.Flusher).Flush()
+
+					// Wait until the client has read the event.
+					select {
+					case <-read:
+					case <-time.After(5 * time.Second):
+						return
+					}
+				}
+			}), tt.opts...))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get: error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			enc := resp.Header.Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			var r io.Reader = resp.Body
+			if enc != "" {
+				r, err = newDecodeReader(r, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("newDecodeReader(): error: %v", err)
+				}
+			}
+
+			for _, event := range events {
+				got := make([]byte, len(event))
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatalf("io.ReadFull(): error: %v", err)
+				}
+				read <- struct{}{}
+
+				if string(got) != event {
+					t.Errorf("event is not match: got %#v, want %#v", string(got), event)
+				}
+			}
+		})
+	}
+}
+
+var brotliWindowBitsTests = map[string]struct {
+	sizeHint int64
+	bits     int
+}{
+	"unknown": {
+		sizeHint: 0,
+		bits:     0,
+	},
+	"small": {
+		sizeHint: 100,
+		bits:     10,
+	},
+	"medium": {
+		sizeHint: 64*1024 + 1,
+		bits:     17,
+	},
+	"large": {
+		sizeHint: 1 << 30,
+		bits:     24,
+	},
+}
+
+func TestBrotliWindowBits(t *testing.T) {
+	for name, tt := range brotliWindowBitsTests {
+		t.Run(name, func(t *testing.T) {
+			if bits := brotliWindowBits(tt.sizeHint); bits != tt.bits {
+				t.Errorf("brotliWindowBits(%d): got %d, want %d", tt.sizeHint, bits, tt.bits)
+			}
+		})
+	}
+}
+
+func TestSizeHint(t *testing.T) {
+	for _, size := range []int{100, 64 * 1024, 4 * 1024 * 1024} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			content := benchmarkText(size)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Write(content)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "br")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if cl := rec.Header().Get("Content-Length"); cl != "" {
+				t.Errorf("Content-Length must be removed: got %#v", cl)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Brotli)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("response body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var precompressionStatusTests = map[string]struct {
+	next            http.Handler
+	path            string
+	acceptEncoding  string
+	statusCode      int
+	contentType     string
+	contentEncoding string
+	body            string
+}{
+	"decode error": {
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "boom", http.StatusInternalServerError)
+		}),
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		statusCode:      http.StatusInternalServerError,
+		contentType:     "text/plain; charset=utf-8",
+		contentEncoding: "",
+		body:            "boom\n",
+	},
+	"decode not found": {
+		next:            http.FileServer(http.Dir("./testdata")),
+		path:            "/missing.txt.gz",
+		acceptEncoding:  "",
+		statusCode:      http.StatusNotFound,
+		contentType:     "text/plain; charset=utf-8",
+		contentEncoding: "",
+		body:            "404 page not found\n",
+	},
+	"decode created": {
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, _ := os.ReadFile("./testdata/test1.txt.gz")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(b)
+		}),
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		statusCode:      http.StatusCreated,
+		contentType:     "text/plain; charset=utf-8",
+		contentEncoding: "",
+		body:            "Test 1",
+	},
+	"decode range": {
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				http.Error(w, "Range header must be removed", http.StatusBadRequest)
+				return
+			}
+			http.ServeFile(w, r, "./testdata/test1.txt.gz")
+		}),
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		statusCode:      http.StatusOK,
+		contentType:     "text/plain; charset=utf-8",
+		contentEncoding: "",
+		body:            "Test 1",
+	},
+	"precompression not found": {
+		next:            http.FileServer(http.Dir("./testdata")),
+		path:            "/missing.txt.gz",
+		acceptEncoding:  "gzip",
+		statusCode:      http.StatusNotFound,
+		contentType:     "text/plain; charset=utf-8",
+		contentEncoding: "",
+		body:            "404 page not found\n",
+	},
+}
+
+func TestPrecompressionStatus(t *testing.T) {
+	for name, tt := range precompressionStatusTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(tt.next)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			// A range of the precompression content is requested.
+			req.Header.Set("Range", "bytes=0-9")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Errorf("status code is not match: got %d, want %d", rec.Code, tt.statusCode)
+			}
+			if typ := rec.Header().Get("Content-Type"); typ != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, tt.contentType)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if body := rec.Body.String(); body != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestAutoLevel(t *testing.T) {
+	defer func(f func() int) {
+		availableCPUs = f
+	}(availableCPUs)
+
+	type levels struct {
+		gzip, deflate, brotli int
+	}
+	got := map[int]levels{}
+	for _, cpus := range []int{1, 4, 32} {
+		availableCPUs = func() int { return cpus }
+
+		options := newHandler(http.NotFoundHandler(), true, []Option{AutoLevel()}).options
+
+		if options.gzipLevel < gzip.HuffmanOnly || options.gzipLevel > gzip.BestCompression {
+			t.Errorf("%d CPUs: invalid gzip level: %d", cpus, options.gzipLevel)
+		}
+		if options.deflateLevel < zlib.HuffmanOnly || options.deflateLevel > zlib.BestCompression {
+			t.Errorf("%d CPUs: invalid deflate level: %d", cpus, options.deflateLevel)
+		}
+		if options.brotliLevel < brotli.BestSpeed || options.brotliLevel > brotli.BestCompression {
+			t.Errorf("%d CPUs: invalid brotli level: %d", cpus, options.brotliLevel)
+		}
+		got[cpus] = levels{options.gzipLevel, options.deflateLevel, options.brotliLevel}
+	}
+
+	if got[1] == got[4] || got[4] == got[32] || got[1] == got[32] {
+		t.Errorf("levels must differ across CPU counts: got %+v", got)
+	}
+	if got[1].brotli >= got[32].brotli {
+		t.Errorf("brotli level must be higher on more CPUs: got %d (1 CPU), %d (32 CPUs)", got[1].brotli, got[32].brotli)
+	}
+}
+
+var precompressionManifestTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	contentType     string
+	body            string
+}{
+	"precompression": {
+		path:            "/app.js",
+		acceptEncoding:  "gzip, br",
+		contentEncoding: "br",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "console.log('app');",
+	},
+	"decode precompression": {
+		path:            "/app.js",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "console.log('app');",
+	},
+	"not in manifest": {
+		path:            "/test.js",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentType:     "text/javascript; charset=utf-8",
+		body:            "console.log('test');",
+	},
+}
+
+func TestPrecompressionManifest(t *testing.T) {
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	bw.Write([]byte("console.log('app');"))
+	bw.Close()
+
+	fsys := fstest.MapFS{
+		"dist/app.c0ffee.br": &fstest.MapFile{Data: buf.Bytes()},
+		"test.js":            &fstest.MapFile{Data: []byte("console.log('test');")},
+	}
+	h := Handler(http.FileServer(http.FS(fsys)), PrecompressionManifest(map[string]PrecompressedFile{
+		"/app.js": {Path: "/dist/app.c0ffee.br", Encoding: Brotli},
+	}))
+
+	for name, tt := range precompressionManifestTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("invalid status: %d", rec.Code)
+			}
+			if typ := rec.Header().Get("Content-Type"); typ != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, tt.contentType)
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+var disableCompressionTests = map[string]struct {
+	disable         func(w http.ResponseWriter)
+	contentEncoding string
+}{
+	"disabled": {
+		disable: func(w http.ResponseWriter) {
+			w.(CompressionDisabler).DisableCompression()
+			w.Write([]byte("content"))
+		},
+		contentEncoding: "",
+	},
+	"identity": {
+		disable: func(w http.ResponseWriter) {
+			w.Header().Set("Content-Encoding", "identity")
+			w.Write([]byte("content"))
+		},
+		contentEncoding: "",
+	},
+	"too late": {
+		disable: func(w http.ResponseWriter) {
+			w.Write([]byte("content"))
+			w.(CompressionDisabler).DisableCompression()
+		},
+		contentEncoding: "gzip",
+	},
+}
+
+func TestDisableCompression(t *testing.T) {
+	for name, tt := range disableCompressionTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.disable(w)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if tt.contentEncoding == "" {
+				if enc, ok := rec.Header()["Content-Encoding"]; ok {
+					t.Fatalf("Content-Encoding must not be set: got %#v", enc)
+				}
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != "content" {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), "content")
+			}
+		})
+	}
+}
+
+func FuzzNegotiate(f *testing.F) {
+	seeds := []string{
+		"gzip, deflate, br",
+		"gzip, deflate, br, zstd",
+		"gzip, deflate",
+		"br;q=1.0, gzip;q=0.8, *;q=0.1",
+		"gzip;q=0, *;q=1",
+		"identity",
+		"*",
+		"",
+		";q=",
+		"gzip;q=2",
+		"gzip;;q=0.5,,",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	available := []EncodingType{Brotli, Gzip, Deflate}
+	f.Fuzz(func(t *testing.T, acceptEncoding string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+
+		enc, ok := NegotiateEncoding(req, available)
+		if !ok {
+			if enc != "" {
+				t.Errorf("NegotiateEncoding(%q): encoding must be empty if not ok: got %#v", acceptEncoding, enc)
+			}
+			return
+		}
+		if !enc.IsValid() {
+			t.Errorf("NegotiateEncoding(%q): invalid encoding: %#v", acceptEncoding, enc)
+		}
+	})
+}
+
+var contentTypeMatcherTests = map[string]struct {
+	patterns  []string
+	mediaType string
+	want      bool
+}{
+	"exact":               {patterns: []string{"Text/HTML"}, mediaType: "text/html", want: true},
+	"exact not matched":   {patterns: []string{"text/html"}, mediaType: "text/csv", want: false},
+	"type wildcard":       {patterns: []string{"text/*"}, mediaType: "text/csv", want: true},
+	"type wildcard other": {patterns: []string{"text/*"}, mediaType: "application/csv", want: false},
+	"suffix":              {patterns: []string{"*+json"}, mediaType: "application/vnd.api+json", want: true},
+	"suffix full":         {patterns: []string{"*/*+json"}, mediaType: "application/vnd.api+json", want: true},
+	"suffix xml":          {patterns: []string{"*/*+xml"}, mediaType: "image/svg+xml", want: true},
+	"suffix not matched":  {patterns: []string{"*+json"}, mediaType: "application/json", want: false},
+	"any":                 {patterns: []string{"*/*"}, mediaType: "image/png", want: true},
+	"multiple":            {patterns: []string{"image/png", "text/*", "*+xml"}, mediaType: "application/atom+xml", want: true},
+	"empty media type":    {patterns: []string{"*/*"}, mediaType: "", want: false},
+}
+
+func TestContentTypeMatcher(t *testing.T) {
+	for name, tt := range contentTypeMatcherTests {
+		t.Run(name, func(t *testing.T) {
+			m := &contentTypeMatcher{}
+			for _, pattern := range tt.patterns {
+				m.add(pattern)
+			}
+			if got := m.match(tt.mediaType); got != tt.want {
+				t.Errorf("match(%q) is not match: got %v, want %v", tt.mediaType, got, tt.want)
+			}
+		})
+	}
+}
+
+var onSkipTests = map[string]struct {
+	opts            []Option
+	method          string
+	acceptEncoding  string
+	contentType     string
+	body            string
+	contentEncoding string
+	reasons         []string
+}{
+	"min size": {
+		opts:            []Option{MinSize(100)},
+		acceptEncoding:  "gzip",
+		contentType:     "text/plain",
+		body:            "small content",
+		contentEncoding: "",
+		reasons:         []string{ReasonMinSize},
+	},
+	"min size exceeded": {
+		opts:            []Option{MinSize(100)},
+		acceptEncoding:  "gzip",
+		contentType:     "text/plain",
+		body:            strings.Repeat("large content\n", 10),
+		contentEncoding: "gzip",
+		reasons:         nil,
+	},
+	"content type": {
+		opts:            []Option{SkipContentTypes("image/png", "Application/Zip")},
+		acceptEncoding:  "gzip",
+		contentType:     "application/zip",
+		body:            "zip content",
+		contentEncoding: "",
+		reasons:         []string{ReasonContentType},
+	},
+	"content type not matched": {
+		opts:            []Option{SkipContentTypes("image/png", "application/zip")},
+		acceptEncoding:  "gzip",
+		contentType:     "text/plain; charset=utf-8",
+		body:            "text content",
+		contentEncoding: "gzip",
+		reasons:         nil,
+	},
+	"content type wildcard": {
+		opts:            []Option{SkipContentTypes("image/*")},
+		acceptEncoding:  "gzip",
+		contentType:     "image/svg+xml",
+		body:            "svg content",
+		contentEncoding: "",
+		reasons:         []string{ReasonContentType},
+	},
+	"compress content type suffix": {
+		opts:            []Option{CompressContentTypes("text/*", "*/*+json")},
+		acceptEncoding:  "gzip",
+		contentType:     "application/vnd.api+json",
+		body:            "json content",
+		contentEncoding: "gzip",
+		reasons:         nil,
+	},
+	"compress content type not matched": {
+		opts:            []Option{CompressContentTypes("text/*", "*/*+json")},
+		acceptEncoding:  "gzip",
+		contentType:     "application/octet-stream",
+		body:            "binary content",
+		contentEncoding: "",
+		reasons:         []string{ReasonContentType},
+	},
+	"not accepted": {
+		acceptEncoding:  "",
+		contentType:     "text/plain",
+		body:            "text content",
+		contentEncoding: "",
+		reasons:         []string{ReasonNotAccepted},
+	},
+	"method": {
+		method:          http.MethodPut,
+		acceptEncoding:  "gzip",
+		contentType:     "text/plain",
+		body:            "text content",
+		contentEncoding: "",
+		reasons:         []string{ReasonMethod},
+	},
+	"status": {
+		opts:            []Option{CompressStatuses(http.StatusNotFound)},
+		acceptEncoding:  "gzip",
+		contentType:     "text/plain",
+		body:            "text content",
+		contentEncoding: "",
+		reasons:         []string{ReasonStatus},
+	},
+}
+
+func TestOnSkip(t *testing.T) {
+	for name, tt := range onSkipTests {
+		t.Run(name, func(t *testing.T) {
+			var reasons []string
+			opts := append([]Option{OnSkip(func(reason string, r *http.Request) {
+				reasons = append(reasons, reason)
+			})}, tt.opts...)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}), opts...)
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("reasons are not match: got %#v, want %#v", reasons, tt.reasons)
+			}
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if enc != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(enc))
+				if err != nil {
+					t.Fatalf("decodeBody(): %v", err)
+				}
+			}
+			if string(body) != tt.body {
+				t.Errorf("response body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(strings.Repeat("upstream content\n", 100)))
+	gw.Close()
+	encoded := buf.Bytes()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip")
+		// Write in pieces with flushes, so that the response is chunked.
+		for i := 0; i < len(encoded); i += 100 {
+			end := i + 100
+			if end > len(encoded) {
+				end = len(encoded)
+			}
+			w.Write(encoded[i:end])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("url.Parse(): error: %v", err)
+	}
+
+	var reasons []string
+	proxy := httptest.NewServer(Handler(httputil.NewSingleHostReverseProxy(backendURL), OnSkip(func(reason string, r *http.Request) {
+		reasons = append(reasons, reason)
+	})))
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): error: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Get: error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll(resp.Body): error: %v", err)
+	}
+
+	if enc := resp.Header.Values("Content-Encoding"); len(enc) != 1 || enc[0] != "gzip" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, []string{"gzip"})
+	}
+	if !bytes.Equal(body, encoded) {
+		t.Errorf("response body is not passed through")
+	}
+	if !reflect.DeepEqual(reasons, []string{ReasonEncoded}) {
+		t.Errorf("reasons are not match: got %#v, want %#v", reasons, []string{ReasonEncoded})
+	}
+}
+
+func TestEarlyHints(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("content"))
+	})))
+	defer server.Close()
+
+	var hints []http.Header
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, http.Header(header))
+			}
+			return nil
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): error: %v", err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Get: error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if len(hints) != 1 {
+		t.Fatalf("number of early hints is not match: got %d, want %d", len(hints), 1)
+	}
+	if link := hints[0].Get("Link"); link != "</style.css>; rel=preload; as=style" {
+		t.Errorf("Link of early hints is not match: got %#v", link)
+	}
+	if enc := hints[0].Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding must not be set to early hints: got %#v", enc)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("invalid status: %s", resp.Status)
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll(resp.Body): error: %v", err)
+	}
+	body, err = decodeBody(body, Gzip)
+	if err != nil {
+		t.Fatalf("decodeBody(): %v", err)
+	}
+	if string(body) != "content" {
+		t.Errorf("response body is not match: got %#v, want %#v", string(body), "content")
+	}
+}
+
+func TestSwitchingProtocols(t *testing.T) {
+	var reasons []string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}), OnSkip(func(reason string, r *http.Request) {
+		reasons = append(reasons, reason)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSwitchingProtocols {
+		t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusSwitchingProtocols)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+	if n := rec.Body.Len(); n != 0 {
+		t.Errorf("body is not empty: got %d bytes", n)
+	}
+	if !reflect.DeepEqual(reasons, []string{ReasonStatus}) {
+		t.Errorf("skip reasons are not match: got %#v, want %#v", reasons, []string{ReasonStatus})
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	for _, enc := range []EncodingType{Gzip, Deflate, Brotli} {
+		t.Run(string(enc), func(t *testing.T) {
+			var want strings.Builder
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 1000; i++ {
+					fmt.Fprintf(w, "line %d\n", i)
+					fmt.Fprintf(&want, "line %d\n", i)
+					if i == 500 {
+						w.(http.Flusher).Flush()
+					}
+				}
+			}), WriteBufferSize(4096))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", string(enc))
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			body, err := decodeBody(rec.Body.Bytes(), enc)
+			if err != nil {
+				t.Fatalf("decodeBody(): %v", err)
+			}
+			if string(body) != want.String() {
+				t.Errorf("response body is not match: got %d bytes, want %d bytes", len(body), want.Len())
+			}
+		})
+	}
+}
+
+// countEncoder is an encoder that counts the Write calls to the underlying encoder.
+type countEncoder struct {
+	io.WriteCloser
+	writes *int
+}
+
+func (w *countEncoder) Write(b []byte) (int, error) {
+	*w.writes++
+	return w.WriteCloser.Write(b)
+}
+
+func BenchmarkSmallWrites(b *testing.B) {
+	// The built-in encoders are registered as custom encoders to count the writes to them.
+	encoders := []struct {
+		typ        EncodingType
+		newEncoder func(w io.Writer) io.WriteCloser
+	}{
+		{Gzip, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{Deflate, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{Brotli, func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }},
+	}
+	for _, enc := range encoders {
+		for _, size := range []int{0, 4096} {
+			b.Run(fmt.Sprintf("%s/WriteBufferSize=%d", enc.typ, size), func(b *testing.B) {
+				const token EncodingType = "count"
+
+				var writes int
+				h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for i := 0; i < 1000; i++ {
+						fmt.Fprintf(w, "<li>item %d</li>\n", i)
+					}
+				}), WriteBufferSize(size), CustomEncoder(token, func(w io.Writer) (io.WriteCloser, error) {
+					return &countEncoder{WriteCloser: enc.newEncoder(w), writes: &writes}, nil
+				}))
+
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", string(token))
+
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					w := &countResponseWriter{header: http.Header{}}
+					h.ServeHTTP(w, req)
+				}
+				b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+			})
+		}
+	}
+}
+
+var skipCompressedAttachmentsTests = map[string]struct {
+	contentDisposition string
+	contentEncoding    string
+}{
+	"zip": {
+		contentDisposition: `attachment; filename="x.zip"`,
+		contentEncoding:    "",
+	},
+	"upper case": {
+		contentDisposition: `attachment; filename="X.TAR.GZ"`,
+		contentEncoding:    "",
+	},
+	"extended filename": {
+		contentDisposition: `attachment; filename*=UTF-8''%E3%83%87%E3%83%BC%E3%82%BF.zip`,
+		contentEncoding:    "",
+	},
+	"text": {
+		contentDisposition: `attachment; filename="x.csv"`,
+		contentEncoding:    "gzip",
+	},
+	"inline": {
+		contentDisposition: `inline; filename="x.zip"`,
+		contentEncoding:    "gzip",
+	},
+	"none": {
+		contentDisposition: "",
+		contentEncoding:    "gzip",
+	},
+}
+
+func TestSkipCompressedAttachments(t *testing.T) {
+	for name, tt := range skipCompressedAttachmentsTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				if tt.contentDisposition != "" {
+					w.Header().Set("Content-Disposition", tt.contentDisposition)
+				}
+				w.Write([]byte("content"))
+			}), SkipCompressedAttachments())
+
+			req := httptest.NewRequest(http.MethodGet, "/download", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+		})
+	}
+}
+
+var deterministicOutputTests = map[string]struct {
+	enc     EncodingType
+	options []Option
+	// identical is true if the output does not depend on the Content-Length header.
+	identical bool
+}{
+	"brotli": {
+		enc:       Brotli,
+		options:   []Option{DeterministicOutput()},
+		identical: true,
+	},
+	"brotli without option": {
+		enc:       Brotli,
+		identical: false,
+	},
+	"gzip without option": {
+		enc:       Gzip,
+		identical: true,
+	},
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	content := benchmarkText(4096)
+
+	for name, tt := range deterministicOutputTests {
+		t.Run(name, func(t *testing.T) {
+			serve := func(contentLength bool) []byte {
+				h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if contentLength {
+						w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+					}
+					w.Write(content)
+				}), tt.options...)
+
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Accept-Encoding", string(tt.enc))
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+
+				return rec.Body.Bytes()
+			}
+
+			b1 := serve(false)
+			b2 := serve(true)
+			if identical := bytes.Equal(b1, b2); identical != tt.identical {
+				t.Errorf("identical is not match: got %v, want %v", identical, tt.identical)
+			}
+
+			if tt.enc == Gzip {
+				zr, err := gzip.NewReader(bytes.NewReader(b1))
+				if err != nil {
+					t.Fatalf("gzip.NewReader(): error: %v", err)
+				}
+				if !zr.ModTime.IsZero() {
+					t.Errorf("ModTime is not match: got %v, want zero", zr.ModTime)
+				}
+				if zr.OS != 255 {
+					t.Errorf("OS is not match: got %#v, want %#v", zr.OS, 255)
+				}
+			}
+		})
+	}
+}
+
+var precompressionRangeTests = map[string]struct {
+	rangeHeader     string
+	statusCode      int
+	contentEncoding string
+	contentRange    string
+	start, end      int
+}{
+	"first bytes": {
+		rangeHeader:     "bytes=0-9",
+		statusCode:      http.StatusPartialContent,
+		contentEncoding: "gzip",
+		contentRange:    "bytes 0-9/36",
+		start:           0,
+		end:             10,
+	},
+	"suffix": {
+		rangeHeader:     "bytes=-8",
+		statusCode:      http.StatusPartialContent,
+		contentEncoding: "gzip",
+		contentRange:    "bytes 28-35/36",
+		start:           28,
+		end:             36,
+	},
+	"unsatisfiable": {
+		rangeHeader:     "bytes=100-200",
+		statusCode:      http.StatusRequestedRangeNotSatisfiable,
+		contentEncoding: "",
+		contentRange:    "bytes */36",
+	},
+}
+
+func TestPrecompressionRange(t *testing.T) {
+	content, err := os.ReadFile("testdata/test1.txt.gz")
+	if err != nil {
+		t.Fatalf("os.ReadFile(): error: %v", err)
+	}
+
+	h := Handler(http.FileServer(http.Dir("./testdata")))
+
+	for name, tt := range precompressionRangeTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test1.txt.gz", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("Range", tt.rangeHeader)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("status code is not match: got %#v, want %#v", rec.Code, tt.statusCode)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if cr := rec.Header().Get("Content-Range"); cr != tt.contentRange {
+				t.Errorf("Content-Range is not match: got %#v, want %#v", cr, tt.contentRange)
+			}
+			if tt.statusCode != http.StatusPartialContent {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", ct, "text/plain; charset=utf-8")
+			}
+			if body := rec.Body.Bytes(); !bytes.Equal(body, content[tt.start:tt.end]) {
+				t.Errorf("body is not match: got %x, want %x", body, content[tt.start:tt.end])
+			}
+		})
+	}
+}
+
+var smartDefaultsTests = map[string]struct {
+	size            int
+	contentType     string
+	cacheControl    string
+	contentEncoding string
+}{
+	"small text": {
+		size:            500,
+		contentType:     "text/plain",
+		contentEncoding: "",
+	},
+	"large text": {
+		size:            2048,
+		contentType:     "text/plain",
+		contentEncoding: "gzip",
+	},
+	"large json": {
+		size:            2048,
+		contentType:     "application/json; charset=utf-8",
+		contentEncoding: "gzip",
+	},
+	"large image": {
+		size:            2048,
+		contentType:     "image/png",
+		contentEncoding: "",
+	},
+	"no-transform": {
+		size:            2048,
+		contentType:     "text/plain",
+		cacheControl:    "public, No-Transform",
+		contentEncoding: "",
+	},
+}
+
+func TestSmartDefaults(t *testing.T) {
+	for name, tt := range smartDefaultsTests {
+		t.Run(name, func(t *testing.T) {
+			content := benchmarkText(tt.size)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.Write(content)
+			}), SmartDefaults())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body := rec.Body.Bytes()
+			if tt.contentEncoding != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var acceptedEncodingsTests = map[string]struct {
+	acceptEncoding string
+	encodings      []EncodingType
+}{
+	"q-values": {
+		acceptEncoding: "gzip;q=0.5, deflate;q=0.1, br;q=0.8",
+		encodings:      []EncodingType{Brotli, Gzip, Deflate},
+	},
+	"q=0": {
+		acceptEncoding: "gzip, br;q=0, deflate;q=0.5",
+		encodings:      []EncodingType{Gzip, Deflate},
+	},
+	"wildcard": {
+		acceptEncoding: "deflate, *;q=0.5",
+		encodings:      []EncodingType{Deflate, Brotli, Gzip},
+	},
+	"unsupported": {
+		acceptEncoding: "compress, identity",
+		encodings:      nil,
+	},
+	"missing": {
+		acceptEncoding: "",
+		encodings:      nil,
+	},
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	for name, tt := range acceptedEncodingsTests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			encs := AcceptedEncodings(req)
+			if !reflect.DeepEqual(encs, tt.encodings) {
+				t.Errorf("AcceptedEncodings(): encodings is not match: got %#v, want %#v", encs, tt.encodings)
+			}
+		})
+	}
+}
+
+// grpcWebFrame returns a gRPC-Web frame with flag and data.
+func grpcWebFrame(flag byte, data []byte) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	frame[0] = flag
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func TestGRPCWeb(t *testing.T) {
+	var content []byte
+	content = append(content, grpcWebFrame(0x00, benchmarkText(4096))...)
+	content = append(content, grpcWebFrame(0x80, []byte("grpc-status: 0\r\ngrpc-message: OK\r\n"))...)
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", contentType)
+				w.Write(content)
+			}), SmartDefaults())
+
+			req := httptest.NewRequest(http.MethodPost, "/service/Method", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Gzip)
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %x, want %x", body, content)
+			}
+		})
+	}
+}
+
+var sniffContentTypeTests = map[string]struct {
+	content         []byte
+	writeHeader     bool
+	options         []Option
+	contentType     string
+	contentEncoding string
+}{
+	"html": {
+		content:         []byte("<!DOCTYPE html><html><body>Hello</body></html>"),
+		contentType:     "text/html; charset=utf-8",
+		contentEncoding: "gzip",
+	},
+	"html after WriteHeader": {
+		content:         []byte("<!DOCTYPE html><html><body>Hello</body></html>"),
+		writeHeader:     true,
+		contentType:     "text/html; charset=utf-8",
+		contentEncoding: "gzip",
+	},
+	"png with allowlist": {
+		content:         append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), benchmarkText(2048)...),
+		options:         []Option{SmartDefaults()},
+		contentType:     "image/png",
+		contentEncoding: "",
+	},
+}
+
+func TestSniffContentType(t *testing.T) {
+	for name, tt := range sniffContentTypeTests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.writeHeader {
+					w.WriteHeader(http.StatusOK)
+				}
+				w.Write(tt.content)
+			}), tt.options...))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get: error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if ct := resp.Header.Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", ct, tt.contentType)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll(): error: %v", err)
+			}
+			if tt.contentEncoding != "" {
+				body, err = decodeBody(body, EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+			}
+			if !bytes.Equal(body, tt.content) {
+				t.Errorf("body is not match: got %q, want %q", body, tt.content)
+			}
+		})
+	}
+}
+
+var timeoutHandlerTests = map[string]struct {
+	outer           bool
+	timeout         bool
+	statusCode      int
+	contentEncoding string
+}{
+	"outer": {
+		outer:           true,
+		statusCode:      http.StatusOK,
+		contentEncoding: "gzip",
+	},
+	"outer timeout": {
+		outer:           true,
+		timeout:         true,
+		statusCode:      http.StatusServiceUnavailable,
+		contentEncoding: "gzip",
+	},
+	"inner": {
+		statusCode:      http.StatusOK,
+		contentEncoding: "gzip",
+	},
+	"inner timeout": {
+		timeout:         true,
+		statusCode:      http.StatusServiceUnavailable,
+		contentEncoding: "",
+	},
+}
+
+func TestTimeoutHandler(t *testing.T) {
+	const timeoutMessage = "timeout"
+	content := benchmarkText(4096)
+
+	for name, tt := range timeoutHandlerTests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			done := make(chan struct{})
+			defer close(done)
+
+			var next http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.timeout {
+					select {
+					case <-r.Context().Done():
+					case <-done:
+					}
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			})
+
+			var h http.Handler
+			if tt.outer {
+				h = Handler(http.TimeoutHandler(next, 50*time.Millisecond, timeoutMessage))
+			} else {
+				h = http.TimeoutHandler(Handler(next), 50*time.Millisecond, timeoutMessage)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("status code is not match: got %#v, want %#v", rec.Code, tt.statusCode)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if tt.contentEncoding != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+			}
+			want := content
+			if tt.timeout {
+				want = []byte(timeoutMessage)
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("body is not match: got %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+var assumeGzipIfAbsentTests = map[string]struct {
+	acceptEncoding  []string
+	options         []Option
+	contentEncoding string
+}{
+	"absent": {
+		acceptEncoding:  nil,
+		options:         []Option{AssumeGzipIfAbsent()},
+		contentEncoding: "gzip",
+	},
+	"empty": {
+		acceptEncoding:  []string{""},
+		options:         []Option{AssumeGzipIfAbsent()},
+		contentEncoding: "",
+	},
+	"brotli": {
+		acceptEncoding:  []string{"br"},
+		options:         []Option{AssumeGzipIfAbsent()},
+		contentEncoding: "br",
+	},
+	"default": {
+		acceptEncoding:  nil,
+		options:         nil,
+		contentEncoding: "",
+	},
+}
+
+func TestAssumeGzipIfAbsent(t *testing.T) {
+	content := benchmarkText(1024)
+
+	for name, tt := range assumeGzipIfAbsentTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.acceptEncoding != nil {
+				req.Header["Accept-Encoding"] = tt.acceptEncoding
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body := rec.Body.Bytes()
+			if tt.contentEncoding != "" {
+				var err error
+				body, err = decodeBody(body, EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+func TestXBrotli(t *testing.T) {
+	content := benchmarkText(1024)
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(content)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "x-brotli")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "br")
+	}
+	body, err := decodeBody(rec.Body.Bytes(), Brotli)
+	if err != nil {
+		t.Fatalf("decodeBody(): error: %v", err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+	}
+}
+
+var decodeWritesTests = map[string]struct {
+	contentSize int
+	chunkSize   int
+}{
+	"small at once":    {contentSize: 1024, chunkSize: 0},
+	"small in chunks":  {contentSize: 1024, chunkSize: 100},
+	"large at once":    {contentSize: 256 * 1024, chunkSize: 0},
+	"large in chunks":  {contentSize: 256 * 1024, chunkSize: 1000},
+	"empty":            {contentSize: 0, chunkSize: 0},
+	"small in 1 bytes": {contentSize: 64, chunkSize: 1},
+}
+
+func TestDecodeWrites(t *testing.T) {
+	for name, tt := range decodeWritesTests {
+		for _, enc := range []EncodingType{Gzip, Brotli} {
+			t.Run(fmt.Sprintf("%s/%s", name, enc), func(t *testing.T) {
+				content := benchmarkText(tt.contentSize)
+				compressed, err := Encode(enc, 5, content)
+				if err != nil {
+					t.Fatalf("Encode(): error: %v", err)
+				}
+
+				h := DecodeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+					chunkSize := tt.chunkSize
+					if chunkSize == 0 {
+						chunkSize = len(compressed)
+					}
+					for b := compressed; len(b) > 0; {
+						n := chunkSize
+						if n > len(b) {
+							n = len(b)
+						}
+						if _, err := w.Write(b[:n]); err != nil {
+							t.Errorf("Write(): error: %v", err)
+							return
+						}
+						b = b[n:]
+					}
+				}))
+
+				ext := map[EncodingType]string{Gzip: ".gz", Brotli: ".br"}[enc]
+				req := httptest.NewRequest(http.MethodGet, "/content.txt"+ext, nil)
+				rec := httptest.NewRecorder()
+
+				h.ServeHTTP(rec, req)
+
+				if body := rec.Body.Bytes(); !bytes.Equal(body, content) {
+					t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDecodeSmall(b *testing.B) {
+	compressed, err := Encode(Gzip, gzip.DefaultCompression, benchmarkText(4096))
+	if err != nil {
+		b.Fatalf("Encode(): error: %v", err)
+	}
+
+	for name, chunks := range map[string]int{"single write": 1, "split writes": 2} {
+		h := DecodeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The content written in multiple chunks is decoded by the goroutine.
+			w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+			n := len(compressed) / chunks
+			w.Write(compressed[:n])
+			w.Write(compressed[n:])
+		}))
+
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/content.txt.gz", nil)
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := &countResponseWriter{header: http.Header{}}
+				h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+// writeChunks writes b to w in chunks of size bytes.
+func writeChunks(w io.Writer, b []byte, size int) {
+	for len(b) > 0 {
+		n := size
+		if n > len(b) {
+			n = len(b)
+		}
+		w.Write(b[:n])
+		b = b[n:]
+	}
+}
+
+func TestDecodePipeBuffer(t *testing.T) {
+	content := benchmarkText(64 * 1024)
+	compressed, err := Encode(Gzip, gzip.DefaultCompression, content)
+	if err != nil {
+		t.Fatalf("Encode(): error: %v", err)
+	}
+
+	for _, size := range []int{16, 4096, 1 << 20} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			h := DecodeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeChunks(w, compressed, 256)
+			}), DecodePipeBuffer(size))
+
+			req := httptest.NewRequest(http.MethodGet, "/content.txt.gz", nil)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if !bytes.Equal(rec.Body.Bytes(), content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", rec.Body.Len(), len(content))
+			}
+		})
+	}
+}
+
+func BenchmarkDecodePipeBuffer(b *testing.B) {
+	compressed, err := Encode(Gzip, gzip.DefaultCompression, benchmarkText(256*1024))
+	if err != nil {
+		b.Fatalf("Encode(): error: %v", err)
+	}
+
+	for name, opts := range map[string][]Option{
+		"unbuffered": nil,
+		"buffered":   {DecodePipeBuffer(32 * 1024)},
+	} {
+		h := DecodeHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The content is written in small chunks, such as by a template.
+			writeChunks(w, compressed, 256)
+		}), opts...)
+
+		b.Run(name, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/content.txt.gz", nil)
+
+			b.SetBytes(int64(len(compressed)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := &countResponseWriter{header: http.Header{}}
+				h.ServeHTTP(w, req)
+			}
+		})
+	}
+}
+
+var transformationWarningTests = map[string]struct {
+	path           string
+	acceptEncoding string
+	options        []Option
+	warning        string
+}{
+	"encode": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		options:        []Option{TransformationWarning()},
+		warning:        `214 - "Transformation Applied"`,
+	},
+	"decode": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "",
+		options:        []Option{TransformationWarning()},
+		warning:        `214 - "Transformation Applied"`,
+	},
+	"transcode": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "br",
+		options:        []Option{TransformationWarning(), TranscodePrecompression()},
+		warning:        `214 - "Transformation Applied"`,
+	},
+	"precompression": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "gzip",
+		options:        []Option{TransformationWarning()},
+		warning:        "",
+	},
+	"not encoded": {
+		path:           "/test3.txt",
+		acceptEncoding: "",
+		options:        []Option{TransformationWarning()},
+		warning:        "",
+	},
+	"disabled": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		options:        nil,
+		warning:        "",
+	},
+}
+
+func TestTransformationWarning(t *testing.T) {
+	for name, tt := range transformationWarningTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			var want []string
+			if tt.warning != "" {
+				want = []string{tt.warning}
+			}
+			if warning := rec.Header().Values("Warning"); !reflect.DeepEqual(warning, want) {
+				t.Errorf("Warning is not match: got %#v, want %#v", warning, want)
+			}
+		})
+	}
+}
+
+var lateHeaderTests = map[string]http.HandlerFunc{
+	"after Write": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("partial content"))
+		w.Header().Set("X-Late", "late")
+		w.Write([]byte("rest of content"))
+	},
+	"after WriteHeader": func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("X-Late", "late")
+		w.Header().Del("Content-Type")
+		w.Write([]byte("content"))
+	},
+	"Content-Type after Write": func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<!DOCTYPE html><html></html>"))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Late", "late")
+	},
+	"Content-Type after WriteHeader": func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("<!DOCTYPE html><html></html>"))
+	},
+}
+
+func TestLateHeader(t *testing.T) {
+	get := func(t *testing.T, h http.Handler) *http.Response {
+		server := httptest.NewServer(h)
+		defer server.Close()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): error: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Get: error: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		return resp
+	}
+
+	for name, next := range lateHeaderTests {
+		for optsName, opts := range map[string][]Option{
+			"default":       nil,
+			"small MinSize": {MinSize(10)},
+			"large MinSize": {MinSize(1024)},
+		} {
+			t.Run(name+"/"+optsName, func(t *testing.T) {
+				want := get(t, next)
+				got := get(t, Handler(next, opts...))
+
+				for _, key := range []string{"Content-Type", "X-Late"} {
+					if got.Header.Get(key) != want.Header.Get(key) {
+						t.Errorf("%s is not match: got %#v, want %#v", key, got.Header.Get(key), want.Header.Get(key))
+					}
+				}
+			})
+		}
+	}
+}
+
+var precompressionContentTypeTests = map[string]struct {
+	path           string
+	acceptEncoding string
+	options        []Option
+	contentType    string
+}{
+	"no extension": {
+		path:           "/data.gz",
+		acceptEncoding: "gzip",
+		options:        nil,
+		contentType:    "application/octet-stream",
+	},
+	"no extension with override": {
+		path:           "/data.gz",
+		acceptEncoding: "gzip",
+		options:        []Option{PrecompressionContentType("text/plain; charset=utf-8")},
+		contentType:    "text/plain; charset=utf-8",
+	},
+	"no extension with override decoded": {
+		path:           "/data.gz",
+		acceptEncoding: "",
+		options:        []Option{PrecompressionContentType("text/plain; charset=utf-8")},
+		contentType:    "text/plain; charset=utf-8",
+	},
+	"extension with override": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "gzip",
+		options:        []Option{PrecompressionContentType("application/json")},
+		contentType:    "text/plain; charset=utf-8",
+	},
+}
+
+func TestPrecompressionContentType(t *testing.T) {
+	for name, tt := range precompressionContentTypeTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", ct, tt.contentType)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.acceptEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.acceptEncoding)
+			}
+		})
+	}
+}
+
+func TestPrecompressionContentTypeInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("PrecompressionContentType(): must panic with an invalid content type")
+		}
+	}()
+
+	newHandler(http.NotFoundHandler(), true, []Option{PrecompressionContentType("text/")})
+}
+
+var skipByFetchDestTests = map[string]struct {
+	path            string
+	fetchDest       string
+	contentEncoding string
+}{
+	"image": {
+		path:            "/test3.txt",
+		fetchDest:       "image",
+		contentEncoding: "",
+	},
+	"font": {
+		path:            "/test3.txt",
+		fetchDest:       "font",
+		contentEncoding: "",
+	},
+	"document": {
+		path:            "/test3.txt",
+		fetchDest:       "document",
+		contentEncoding: "gzip",
+	},
+	"absent": {
+		path:            "/test3.txt",
+		fetchDest:       "",
+		contentEncoding: "gzip",
+	},
+	"image precompression": {
+		path:            "/test1.txt.gz",
+		fetchDest:       "image",
+		contentEncoding: "gzip",
+	},
+}
+
+func TestSkipByFetchDest(t *testing.T) {
+	var reasons []string
+	h := Handler(http.FileServer(http.Dir("./testdata")),
+		SkipByFetchDest("image", "video", "audio", "font"),
+		OnSkip(func(reason string, r *http.Request) {
+			reasons = append(reasons, reason)
+		}))
+
+	for name, tt := range skipByFetchDestTests {
+		t.Run(name, func(t *testing.T) {
+			reasons = nil
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			if tt.fetchDest != "" {
+				req.Header.Set("Sec-Fetch-Dest", tt.fetchDest)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if tt.contentEncoding == "" && !reflect.DeepEqual(reasons, []string{ReasonFetchDest}) {
+				t.Errorf("reasons is not match: got %#v, want %#v", reasons, []string{ReasonFetchDest})
+			}
+		})
+	}
+}
+
+var disablePrecompressionTests = map[string]struct {
+	acceptEncoding  string
+	options         []Option
+	contentType     string
+	contentEncoding string
+	decoded         bool
+}{
+	"disabled": {
+		acceptEncoding:  "",
+		options:         []Option{DisablePrecompression()},
+		contentType:     "application/octet-stream",
+		contentEncoding: "",
+		decoded:         false,
+	},
+	"disabled and encoded": {
+		acceptEncoding:  "br",
+		options:         []Option{DisablePrecompression()},
+		contentType:     "application/octet-stream",
+		contentEncoding: "br",
+		decoded:         false,
+	},
+	"enabled": {
+		acceptEncoding:  "",
+		options:         nil,
+		contentType:     "application/octet-stream",
+		contentEncoding: "",
+		decoded:         true,
+	},
+}
+
+func TestDisablePrecompression(t *testing.T) {
+	archive, err := Encode(Gzip, gzip.DefaultCompression, []byte("Test archive"))
+	if err != nil {
+		t.Fatalf("Encode(): error: %v", err)
+	}
+
+	for name, tt := range disablePrecompressionTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(archive)
+			}), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, "/archive.gz", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", ct, tt.contentType)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+
+			body := rec.Body.Bytes()
+			if tt.contentEncoding != "" {
+				body, err = decodeBody(body, EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+			}
+			want := archive
+			if tt.decoded {
+				want = []byte("Test archive")
+			}
+			if !bytes.Equal(body, want) {
+				t.Errorf("body is not match: got %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+var forcedEncodingTests = map[string]struct {
+	acceptEncoding  string
+	forced          EncodingType
+	contentEncoding string
+}{
+	"forced gzip": {
+		acceptEncoding:  "br, gzip",
+		forced:          Gzip,
+		contentEncoding: "gzip",
+	},
+	"forced deflate by wildcard": {
+		acceptEncoding:  "br, *;q=0.1",
+		forced:          Deflate,
+		contentEncoding: "deflate",
+	},
+	"not accepted": {
+		acceptEncoding:  "br",
+		forced:          Gzip,
+		contentEncoding: "br",
+	},
+	"not available": {
+		acceptEncoding:  "br, zstd",
+		forced:          "zstd",
+		contentEncoding: "br",
+	},
+	"not forced": {
+		acceptEncoding:  "br, gzip",
+		forced:          "",
+		contentEncoding: "br",
+	},
+}
+
+func TestWithForcedEncoding(t *testing.T) {
+	content := benchmarkText(1024)
+
+	for name, tt := range forcedEncodingTests {
+		t.Run(name, func(t *testing.T) {
+			var h http.Handler = Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}))
+			if tt.forced != "" {
+				next := h
+				h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					next.ServeHTTP(w, r.WithContext(WithForcedEncoding(r.Context(), tt.forced)))
+				})
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(tt.contentEncoding))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var writerHeaderTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	options         []Option
+	contentEncoding string
+	contentLength   string
+}{
+	"encode": {
+		path:            "/test3.txt",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentLength:   "",
+	},
+	"decode": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		contentLength:   "",
+	},
+	"transcode": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "br",
+		options:         []Option{TranscodePrecompression()},
+		contentEncoding: "br",
+		contentLength:   "",
+	},
+	"precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		contentLength:   "36",
+	},
+	"passthrough": {
+		path:            "/test3.txt",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		contentLength:   "6",
+	},
+}
+
+func TestWriterHeader(t *testing.T) {
+	for name, tt := range writerHeaderTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			header := rec.Result().Header
+			if enc := header.Values("Content-Encoding"); len(enc) > 1 || header.Get("Content-Encoding") != tt.contentEncoding {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if cl := header.Get("Content-Length"); cl != tt.contentLength {
+				t.Errorf("Content-Length is not match: got %#v, want %#v", cl, tt.contentLength)
+			}
+		})
+	}
+}
+
+// slowResponseWriter is a http.ResponseWriter that is slow to write.
+type slowResponseWriter struct {
+	*httptest.ResponseRecorder
+	delay time.Duration
+}
+
+func (w *slowResponseWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseRecorder.Write(b)
+}
+
+var onDecodeStallTests = map[string]struct {
+	threshold time.Duration
+	delay     time.Duration
+	// whole is true if the whole content is written at once, and decoded synchronously.
+	whole   bool
+	stalled bool
+}{
+	"slow": {
+		threshold: 10 * time.Millisecond,
+		delay:     20 * time.Millisecond,
+		stalled:   true,
+	},
+	"slow whole": {
+		threshold: 10 * time.Millisecond,
+		delay:     20 * time.Millisecond,
+		whole:     true,
+		stalled:   true,
+	},
+	"fast": {
+		threshold: time.Second,
+		delay:     0,
+		stalled:   false,
+	},
+}
+
+func TestOnDecodeStall(t *testing.T) {
+	content := benchmarkText(256 * 1024)
+	compressed, err := Encode(Gzip, gzip.DefaultCompression, content)
+	if err != nil {
+		t.Fatalf("Encode(): error: %v", err)
+	}
+
+	for name, tt := range onDecodeStallTests {
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			var stalls []time.Duration
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.whole {
+					w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+					w.Write(compressed)
+					return
+				}
+				// The content written in multiple chunks is decoded by the goroutine.
+				n := len(compressed) / 2
+				w.Write(compressed[:n])
+				w.Write(compressed[n:])
+			}), OnDecodeStall(tt.threshold, func(d time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				stalls = append(stalls, d)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/content.txt.gz", nil)
+			w := &slowResponseWriter{ResponseRecorder: httptest.NewRecorder(), delay: tt.delay}
+
+			h.ServeHTTP(w, req)
+
+			if body := w.Body.Bytes(); !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if stalled := len(stalls) > 0; stalled != tt.stalled {
+				t.Fatalf("stalled is not match: got %v, want %v", stalled, tt.stalled)
+			}
+			for _, d := range stalls {
+				if d < tt.threshold {
+					t.Errorf("stall is shorter than the threshold: got %v, want >= %v", d, tt.threshold)
+				}
+			}
+		})
+	}
+}
+
+func TestOnDecodeStallBlocked(t *testing.T) {
+	content := benchmarkText(256 * 1024)
+	compressed, err := Encode(Gzip, gzip.DefaultCompression, content)
+	if err != nil {
+		t.Fatalf("Encode(): error: %v", err)
+	}
+
+	// The client is stalled until the stall is reported.
+	w := &blockingResponseWriter{
+		ResponseWriter: httptest.NewRecorder(),
+		unblock:        make(chan struct{}),
+	}
+	var once sync.Once
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := len(compressed) / 2
+		w.Write(compressed[:n])
+		w.Write(compressed[n:])
+	}), OnDecodeStall(10*time.Millisecond, func(d time.Duration) {
+		once.Do(func() {
+			close(w.unblock)
+		})
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/content.txt.gz", nil))
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		once.Do(func() {
+			close(w.unblock)
+		})
+		<-done
+		t.Fatal("stall is not reported while the write is blocked")
+	}
+}
+
+var assumeBrotliForUATests = map[string]struct {
+	userAgent       string
+	acceptEncoding  string
+	contentEncoding string
+}{
+	"matched": {
+		userAgent:       "InternalBrowser/2.0",
+		acceptEncoding:  "gzip, deflate",
+		contentEncoding: "br",
+	},
+	"matched without Accept-Encoding": {
+		userAgent:       "InternalBrowser/2.0",
+		acceptEncoding:  "",
+		contentEncoding: "br",
+	},
+	"matched but refused": {
+		userAgent:       "InternalBrowser/2.0",
+		acceptEncoding:  "gzip, br;q=0",
+		contentEncoding: "gzip",
+	},
+	"not matched": {
+		userAgent:       "OtherBrowser/1.0",
+		acceptEncoding:  "gzip, deflate",
+		contentEncoding: "gzip",
+	},
+}
+
+func TestAssumeBrotliForUA(t *testing.T) {
+	h := Handler(http.FileServer(http.Dir("./testdata")), AssumeBrotliForUA(func(ua string) bool {
+		return strings.HasPrefix(ua, "InternalBrowser/")
+	}))
+
+	for name, tt := range assumeBrotliForUATests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test3.txt", nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(tt.contentEncoding))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if string(body) != "Test 3" {
+				t.Errorf("body is not match: got %#v, want %#v", string(body), "Test 3")
+			}
+		})
+	}
+}
+
+// plainResponseWriter hides the optional interfaces of the underlying http.ResponseWriter.
+type plainResponseWriter struct {
+	http.ResponseWriter
+}
+
+var recorderInterfacesTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	body            string
+}{
+	"encode": {
+		path:            "/test3.txt",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		body:            "Test 3",
+	},
+	"decode": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		body:            "Test 1",
+	},
+	"precompression": {
+		path:            "/test1.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		body:            "Test 1",
+	},
+}
+
+func TestRecorderInterfaces(t *testing.T) {
+	files := http.FileServer(http.Dir("./testdata"))
+
+	for name, tt := range recorderInterfacesTests {
+		for _, plain := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/plain=%v", name, plain), func(t *testing.T) {
+				var hijackErr error
+				h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if hj, ok := w.(http.Hijacker); ok {
+						_, _, hijackErr = hj.Hijack()
+					} else {
+						hijackErr = errHijackNotSupported
+					}
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+					files.ServeHTTP(w, r)
+				}))
+
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				if tt.acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				}
+				rec := httptest.NewRecorder()
+				var w http.ResponseWriter = rec
+				if plain {
+					w = plainResponseWriter{rec}
+				}
+
+				h.ServeHTTP(w, req)
+
+				if hijackErr == nil {
+					t.Error("Hijack(): must fail with httptest.ResponseRecorder")
+				}
+				if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+					t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+				}
+				body, err := decodeBody(rec.Body.Bytes(), EncodingType(tt.contentEncoding))
+				if err != nil {
+					t.Fatalf("decodeBody(): error: %v", err)
+				}
+				if string(body) != tt.body {
+					t.Errorf("body is not match: got %#v, want %#v", string(body), tt.body)
+				}
+			})
+		}
+	}
+}
+
+func TestHijack(t *testing.T) {
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack(): error: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+		rw.Flush()
+	})))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): error: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Get: error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("io.ReadAll(): error: %v", err)
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+	if string(body) != "ok" {
+		t.Errorf("body is not match: got %#v, want %#v", string(body), "ok")
+	}
+}
+
+var wrongContentLengthTests = map[string]struct {
+	contentLength string
+	options       []Option
+}{
+	"too short with MinSize": {
+		contentLength: "3",
+		options:       []Option{MinSize(1024)},
+	},
+	"too long with MinSize": {
+		contentLength: "100",
+		options:       []Option{MinSize(1024)},
+	},
+	"too short with skipped content type": {
+		contentLength: "3",
+		options:       []Option{SkipContentTypes("text/plain")},
+	},
+	"too long with skipped content type": {
+		contentLength: "100",
+		options:       []Option{SkipContentTypes("text/plain")},
+	},
+}
+
+func TestWrongContentLength(t *testing.T) {
+	type result struct {
+		contentLength string
+		body          string
+		readErr       bool
+	}
+	get := func(t *testing.T, h http.Handler) result {
+		server := httptest.NewServer(h)
+		defer server.Close()
+
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): error: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Get: error: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		return result{
+			contentLength: resp.Header.Get("Content-Length"),
+			body:          string(body),
+			readErr:       err != nil,
+		}
+	}
+
+	for name, tt := range wrongContentLengthTests {
+		t.Run(name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", tt.contentLength)
+				w.Write([]byte("hello, world"))
+			})
+
+			want := get(t, next)
+			got := get(t, Handler(next, tt.options...))
+
+			if got != want {
+				t.Errorf("response is not match: got %+v, want %+v", got, want)
+			}
+			if got.contentLength != tt.contentLength {
+				t.Errorf("Content-Length is not match: got %#v, want %#v", got.contentLength, tt.contentLength)
+			}
+		})
+	}
+}
+
+func TestConcurrentSafe(t *testing.T) {
+	const (
+		writers = 8
+		lines   = 100
+	)
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < lines; j++ {
+					fmt.Fprintf(w, "data: %d-%d\n\n", i, j)
+					w.(http.Flusher).Flush()
+				}
+			}(i)
+		}
+		wg.Wait()
+	}), CompressEventStream(), ConcurrentSafe())
+
+	req := httptest.NewRequest(http.MethodGet, "/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+	}
+	body, err := decodeBody(rec.Body.Bytes(), Gzip)
+	if err != nil {
+		t.Fatalf("decodeBody(): error: %v", err)
+	}
+
+	events := strings.Split(strings.TrimSuffix(string(body), "\n\n"), "\n\n")
+	if len(events) != writers*lines {
+		t.Fatalf("number of events is not match: got %d, want %d", len(events), writers*lines)
+	}
+	seen := map[string]bool{}
+	for _, event := range events {
+		seen[event] = true
+	}
+	for i := 0; i < writers; i++ {
+		for j := 0; j < lines; j++ {
+			if event := fmt.Sprintf("data: %d-%d", i, j); !seen[event] {
+				t.Errorf("event is not found: %#v", event)
+			}
+		}
+	}
+}
+
+var varyTests = map[string]struct {
+	path           string
+	acceptEncoding string
+	vary           []string
+	options        []Option
+	want           []string
+}{
+	"encoded": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		want:           []string{"Accept-Encoding"},
+	},
+	"not accepted": {
+		path:           "/test3.txt",
+		acceptEncoding: "",
+		want:           []string{"Accept-Encoding"},
+	},
+	"precompression": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "gzip",
+		want:           []string{"Accept-Encoding"},
+	},
+	"decoded": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "",
+		want:           []string{"Accept-Encoding"},
+	},
+	"already listed": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		vary:           []string{"Origin, accept-encoding"},
+		want:           []string{"Origin, accept-encoding"},
+	},
+	"wildcard": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		vary:           []string{"*"},
+		want:           []string{"*"},
+	},
+	"other field": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		vary:           []string{"Origin"},
+		want:           []string{"Origin", "Accept-Encoding"},
+	},
+	"disabled": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		options:        []Option{DisableVary()},
+		want:           nil,
+	},
+	"disabled precompression": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "gzip",
+		options:        []Option{DisableVary()},
+		want:           nil,
+	},
+}
+
+func TestVary(t *testing.T) {
+	files := http.FileServer(http.Dir("./testdata"))
+
+	for name, tt := range varyTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(files, tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			// The Vary header set by an outer handler.
+			for _, v := range tt.vary {
+				rec.Header().Add("Vary", v)
+			}
+
+			h.ServeHTTP(rec, req)
+
+			if vary := rec.Header().Values("Vary"); !reflect.DeepEqual(vary, tt.want) {
+				t.Errorf("Vary is not match: got %#v, want %#v", vary, tt.want)
+			}
+		})
+	}
+}
+
+var minSizeContentLengthTests = map[string]struct {
+	size            int
+	contentLength   bool
+	contentEncoding string
+	committed       bool
+}{
+	"small with Content-Length": {
+		size:            100,
+		contentLength:   true,
+		contentEncoding: "",
+		committed:       true,
+	},
+	"large with Content-Length": {
+		size:            4096,
+		contentLength:   true,
+		contentEncoding: "gzip",
+		committed:       true,
+	},
+	"small without Content-Length": {
+		size:            100,
+		contentLength:   false,
+		contentEncoding: "",
+		committed:       false,
+	},
+	"large without Content-Length": {
+		size:            4096,
+		contentLength:   false,
+		contentEncoding: "gzip",
+		committed:       false,
+	},
+}
+
+// headerRecorder records whether WriteHeader is called.
+type headerRecorder struct {
+	*httptest.ResponseRecorder
+	wroteHeader bool
+}
+
+func (w *headerRecorder) WriteHeader(statusCode int) {
+	w.wroteHeader = true
+	w.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func TestMinSizeContentLength(t *testing.T) {
+	for name, tt := range minSizeContentLengthTests {
+		t.Run(name, func(t *testing.T) {
+			content := benchmarkText(tt.size)
+			rec := &headerRecorder{ResponseRecorder: httptest.NewRecorder()}
+
+			var committed bool
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if tt.contentLength {
+					w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				}
+				// The first write is smaller than the minimum size.
+				w.Write(content[:50])
+				committed = rec.wroteHeader
+				w.Write(content[50:])
+			}), MinSize(1024))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			h.ServeHTTP(rec, req)
+
+			if committed != tt.committed {
+				t.Errorf("committed is not match: got %v, want %v", committed, tt.committed)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(tt.contentEncoding))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var negotiatorTests = map[string]struct {
+	acceptEncoding  string
+	negotiator      Negotiator
+	contentEncoding string
+}{
+	"default": {
+		acceptEncoding:  "gzip;q=0.5, br",
+		negotiator:      DefaultNegotiator,
+		contentEncoding: "br",
+	},
+	"nil": {
+		acceptEncoding:  "gzip",
+		negotiator:      nil,
+		contentEncoding: "gzip",
+	},
+	"always deflate": {
+		acceptEncoding: "gzip, br",
+		negotiator: NegotiatorFunc(func(r *http.Request, available []EncodingType) (EncodingType, bool) {
+			return Deflate, true
+		}),
+		contentEncoding: "deflate",
+	},
+	"not encoded": {
+		acceptEncoding: "gzip, br",
+		negotiator: NegotiatorFunc(func(r *http.Request, available []EncodingType) (EncodingType, bool) {
+			return "", false
+		}),
+		contentEncoding: "",
+	},
+	"not available": {
+		acceptEncoding: "gzip, br",
+		negotiator: NegotiatorFunc(func(r *http.Request, available []EncodingType) (EncodingType, bool) {
+			return "zstd", true
+		}),
+		contentEncoding: "",
+	},
+}
+
+func TestWithNegotiator(t *testing.T) {
+	content := benchmarkText(1024)
+
+	for name, tt := range negotiatorTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}), WithNegotiator(tt.negotiator))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(tt.contentEncoding))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+// readerFromResponseWriter is a countResponseWriter that implements io.ReaderFrom.
+type readerFromResponseWriter struct {
+	countResponseWriter
+	readFrom bool
+}
+
+func (w *readerFromResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(onlyWriter{&w.countResponseWriter}, src)
+}
+
+func TestPrecompressionStreaming(t *testing.T) {
+	const size = 16 << 20
+
+	root := t.TempDir()
+	content := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := os.WriteFile(filepath.Join(root, "large.bin.gz"), content, 0o644); err != nil {
+		t.Fatalf("os.WriteFile(): error: %v", err)
+	}
+
+	h := Handler(http.FileServer(http.Dir(root)))
+
+	for name, readerFrom := range map[string]bool{
+		"writer":      false,
+		"reader from": true,
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/large.bin.gz", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+
+			rw := &readerFromResponseWriter{countResponseWriter: countResponseWriter{header: http.Header{}}}
+			var w http.ResponseWriter = &rw.countResponseWriter
+			if readerFrom {
+				w = rw
+			}
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+
+			h.ServeHTTP(w, req)
+
+			runtime.ReadMemStats(&after)
+
+			if enc := rw.header.Get("Content-Encoding"); enc != "gzip" {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+			}
+			if rw.n != size {
+				t.Errorf("written bytes is not match: got %d, want %d", rw.n, size)
+			}
+			if rw.readFrom != readerFrom {
+				t.Errorf("ReadFrom is not match: got %v, want %v", rw.readFrom, readerFrom)
+			}
+			if alloc := after.TotalAlloc - before.TotalAlloc; alloc > size/8 {
+				t.Errorf("too many bytes allocated: got %d, want <= %d", alloc, size/8)
+			}
+		})
+	}
+}
+
+func TestDeflateDictionary(t *testing.T) {
+	dict := []byte(`{"id": 0, "name": "", "description": "", "created_at": "", "updated_at": ""}`)
+	content := []byte(`{"id": 1, "name": "test", "description": "test content", "created_at": "2022-01-01", "updated_at": "2022-01-02"}`)
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(content)
+	}), DeflateDictionary(dict))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "deflate")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "deflate" {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "deflate")
+	}
+	encoded := rec.Body.Bytes()
+
+	body, err := io.ReadAll(flate.NewReaderDict(bytes.NewReader(encoded), dict))
+	if err != nil {
+		t.Fatalf("io.ReadAll(): error: %v", err)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("body is not match: got %#v, want %#v", string(body), string(content))
+	}
+
+	// The encoded content is decoded with the dictionary as the precompression content.
+	fsys := fstest.MapFS{
+		"data.json.zz": &fstest.MapFile{Data: encoded},
+	}
+	h = Handler(http.FileServer(http.FS(fsys)), DeflateDictionary(dict), PrecompressionManifest(map[string]PrecompressedFile{
+		"/data.json": {Path: "/data.json.zz", Encoding: Deflate},
+	}))
+
+	req = httptest.NewRequest(http.MethodGet, "/data.json", nil)
+	rec = httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+	if body := rec.Body.String(); body != string(content) {
+		t.Errorf("body is not match: got %#v, want %#v", body, string(content))
+	}
+}
+
+var testOutputEncodingAliasContent = []byte(strings.Repeat("Test content\n", 10))
+
+var outputEncodingAliasTests = map[string]struct {
+	acceptEncoding  string
+	contentEncoding string
+}{
+	"canonical": {
+		acceptEncoding:  "gzip",
+		contentEncoding: "x-gzip",
+	},
+	"legacy": {
+		acceptEncoding:  "x-gzip",
+		contentEncoding: "x-gzip",
+	},
+	"not aliased": {
+		acceptEncoding:  "br",
+		contentEncoding: "br",
+	},
+}
+
+func TestOutputEncodingAlias(t *testing.T) {
+	for name, tt := range outputEncodingAliasTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(testOutputEncodingAliasContent)
+			}), OutputEncodingAlias(Gzip, "x-gzip"))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(canonicalEncoding(tt.contentEncoding)))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, testOutputEncodingAliasContent) {
+				t.Errorf("body is not match: got %#v, want %#v", string(body), string(testOutputEncodingAliasContent))
+			}
+		})
+	}
+}
+
+var decodeCloseTests = map[string]struct {
+	writes int
+	// body is the decoded content, which is partial if the content is partially written.
+	body string
+	// err is true if Close reports the error of the truncated content.
+	err bool
+}{
+	"without write": {
+		writes: 0,
+		body:   "",
+	},
+	"partial write": {
+		writes: 1,
+		body:   "Te",
+		err:    true,
+	},
+	"whole write": {
+		writes: 2,
+		body:   "Test data",
+	},
+}
+
+func TestDecodeClose(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("Test data"))
+	gw.Close()
+	data := buf.Bytes()
+	chunks := [][]byte{data[:len(data)/2], data[len(data)/2:]}
+
+	for name, tt := range decodeCloseTests {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			dw := newDecodeResonseWriter(rec, Gzip, http.Header{}, &handlerOptions{})
+
+			for _, chunk := range chunks[:tt.writes] {
+				if _, err := dw.Write(chunk); err != nil {
+					t.Fatalf("decodeResponseWriter.Write(): error: %v", err)
+				}
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- dw.Close()
+			}()
+			select {
+			case err := <-done:
+				if (err != nil) != tt.err {
+					t.Fatalf("decodeResponseWriter.Close(): error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("decodeResponseWriter.Close() is deadlocked")
+			}
+
+			if body := rec.Body.String(); body != tt.body {
+				t.Errorf("body is not match: got %#v, want %#v", body, tt.body)
+			}
+		})
+	}
+}
+
+// blockingResponseWriter is an http.ResponseWriter whose Write blocks until unblock is closed.
+type blockingResponseWriter struct {
+	http.ResponseWriter
+	unblock chan struct{}
+}
+
+func (w *blockingResponseWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return w.ResponseWriter.Write(b)
+}
+
+func TestDecodeCloseBlocked(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("Test data"))
+	gw.Close()
+
+	rec := httptest.NewRecorder()
+	w := &blockingResponseWriter{
+		ResponseWriter: rec,
+		unblock:        make(chan struct{}),
+	}
+	dw := newDecodeResonseWriter(w, Gzip, http.Header{}, &handlerOptions{})
+	if _, err := dw.Write(buf.Bytes()); err != nil {
+		t.Fatalf("decodeResponseWriter.Write(): error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dw.Close()
+	}()
+
+	// Close must not return while the underlying writer is still in use.
+	select {
+	case <-done:
+		t.Fatal("decodeResponseWriter.Close() returned while the underlying writer is blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(w.unblock)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("decodeResponseWriter.Close(): error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("decodeResponseWriter.Close() is deadlocked")
+	}
+
+	if body := rec.Body.String(); body != "Test data" {
+		t.Errorf("body is not match: got %#v, want %#v", body, "Test data")
+	}
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+	content := benchmarkText(1024)
+
+	var reasons []string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(content))
+	}), CompressStatuses(http.StatusOK, http.StatusRequestedRangeNotSatisfiable), OnSkip(func(reason string, r *http.Request) {
+		reasons = append(reasons, reason)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(content)+1))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+	if cr, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes */%d", len(content)); cr != want {
+		t.Errorf("Content-Range is not match: got %#v, want %#v", cr, want)
+	}
+	if body := rec.Body.String(); !strings.HasPrefix(body, "invalid range") {
+		t.Errorf("body is not match: got %#v", body)
+	}
+	if !reflect.DeepEqual(reasons, []string{ReasonStatus}) {
+		t.Errorf("skip reasons are not match: got %#v, want %#v", reasons, []string{ReasonStatus})
+	}
+}
+
+func TestPartialContent(t *testing.T) {
+	content := benchmarkText(1024)
+
+	var reasons []string
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test.txt", time.Time{}, bytes.NewReader(content))
+	}), OnSkip(func(reason string, r *http.Request) {
+		reasons = append(reasons, reason)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-99")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusPartialContent)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+	}
+	if cr, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes 0-99/%d", len(content)); cr != want {
+		t.Errorf("Content-Range is not match: got %#v, want %#v", cr, want)
+	}
+	if body := rec.Body.Bytes(); !bytes.Equal(body, content[:100]) {
+		t.Errorf("body is not match: got %#v, want %#v", string(body), string(content[:100]))
+	}
+	if !reflect.DeepEqual(reasons, []string{ReasonStatus}) {
+		t.Errorf("skip reasons are not match: got %#v, want %#v", reasons, []string{ReasonStatus})
+	}
+}
+
+var errEncoderFailure = errors.New("encoder failure")
+
+var onErrorTests = map[string]struct {
+	path       string
+	accept     string
+	onError    bool
+	err        error
+	statusCode int
+	body       string
+}{
+	"encoder error": {
+		path:       "/test3.txt",
+		onError:    true,
+		err:        errEncoderFailure,
+		statusCode: http.StatusServiceUnavailable,
+		body:       "custom error\n",
+	},
+	"encoder error without OnError": {
+		path:       "/test3.txt",
+		onError:    false,
+		statusCode: http.StatusOK,
+		body:       "Test 3",
+	},
+	"not acceptable": {
+		path:       "/test1.txt.gz",
+		accept:     "text/html",
+		onError:    true,
+		err:        ErrNotAcceptable,
+		statusCode: http.StatusServiceUnavailable,
+		body:       "custom error\n",
+	},
+	"not acceptable without OnError": {
+		path:       "/test1.txt.gz",
+		accept:     "text/html",
+		onError:    false,
+		statusCode: http.StatusNotAcceptable,
+		body:       "Not Acceptable\n",
+	},
+}
+
+func TestOnError(t *testing.T) {
+	for name, tt := range onErrorTests {
+		t.Run(name, func(t *testing.T) {
+			var gotErr error
+			opts := []Option{
+				ValidatePrecompressAccept(),
+				CustomEncoder("failure", func(w io.Writer) (io.WriteCloser, error) {
+					return nil, errEncoderFailure
+				}),
+			}
+			if tt.onError {
+				opts = append(opts, OnError(func(w http.ResponseWriter, r *http.Request, err error) {
+					gotErr = err
+					http.Error(w, "custom error", http.StatusServiceUnavailable)
+				}))
+			}
+			h := Handler(http.FileServer(http.Dir("./testdata")), opts...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", "failure, gzip;q=0")
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if !errors.Is(gotErr, tt.err) {
+				t.Errorf("error is not match: got %v, want %v", gotErr, tt.err)
+			}
+			if rec.Code != tt.statusCode {
+				t.Errorf("status code is not match: got %d, want %d", rec.Code, tt.statusCode)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+			}
+			if body := rec.Body.String(); body != tt.body {
+				t.Errorf("body is not match: got %#v, want %#v", body, tt.body)
+			}
+		})
+	}
+}
+
+var notModifiedTests = map[string]struct {
+	name            string
+	options         []Option
+	etag            string
+	weakETag        string
+	contentEncoding string
+}{
+	"strong": {
+		name:            "test.txt",
+		etag:            `"v1"`,
+		weakETag:        `W/"v1"`,
+		contentEncoding: "gzip",
+	},
+	"weak": {
+		name:            "test.txt",
+		etag:            `W/"v1"`,
+		weakETag:        `W/"v1"`,
+		contentEncoding: "gzip",
+	},
+	"skipped content type": {
+		name:            "test.png",
+		options:         []Option{SkipContentTypes("image/png")},
+		etag:            `"v1"`,
+		weakETag:        `W/"v1"`,
+		contentEncoding: "",
+	},
+}
+
+func TestNotModified(t *testing.T) {
+	content := benchmarkText(1024)
+
+	for name, tt := range notModifiedTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", tt.etag)
+				http.ServeContent(w, r, tt.name, time.Time{}, bytes.NewReader(content))
+			}), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.name, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusOK)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			etag := rec.Header().Get("ETag")
+			if etag != tt.weakETag {
+				t.Fatalf("ETag is not match: got %#v, want %#v", etag, tt.weakETag)
+			}
+
+			// The conditional request with the ETag of the response.
+			req = httptest.NewRequest(http.MethodGet, "/"+tt.name, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("If-None-Match", etag)
+			rec = httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNotModified {
+				t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusNotModified)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag is not match: got %#v, want %#v", got, etag)
+			}
+			if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+				t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "")
+			}
+			if n := rec.Body.Len(); n != 0 {
+				t.Errorf("body is not empty: got %d bytes", n)
+			}
+		})
+	}
+}
+
+// brotliStreamWindowBits returns the base 2 logarithm of the window size in the brotli stream header of b.
+func brotliStreamWindowBits(b []byte) int {
+	if b[0]&1 == 0 {
+		return 16
+	}
+	if n := b[0] >> 1 & 7; n != 0 {
+		return 17 + int(n)
+	}
+	switch m := b[0] >> 4 & 7; m {
+	case 0:
+		return 17
+	case 1:
+		// The large window brotli is not used.
+		return 0
+	default:
+		return 8 + int(m)
+	}
+}
+
+var brotliWindowByContentTypeTests = map[string]struct {
+	contentType string
+	size        int
+	bits        int
+}{
+	"large text": {
+		contentType: "text/plain",
+		size:        1 << 20,
+		bits:        24,
+	},
+	"small json": {
+		contentType: "application/json",
+		size:        100,
+		bits:        10,
+	},
+	"default": {
+		contentType: "text/css",
+		size:        64*1024 + 1,
+		bits:        17,
+	},
+}
+
+func TestBrotliWindowByContentType(t *testing.T) {
+	opt := BrotliWindowByContentType(func(contentType string, sizeHint int) int {
+		switch {
+		case strings.HasPrefix(contentType, "text/plain") && sizeHint >= 1<<20:
+			return 24
+		case contentType == "application/json":
+			// It is limited to the minimum.
+			return 1
+		}
+		return 0
+	})
+
+	for name, tt := range brotliWindowByContentTypeTests {
+		t.Run(name, func(t *testing.T) {
+			content := benchmarkText(tt.size)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Write(content)
+			}), opt)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "br")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != "br" {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "br")
+			}
+			if bits := brotliStreamWindowBits(rec.Body.Bytes()); bits != tt.bits {
+				t.Errorf("window bits is not match: got %d, want %d", bits, tt.bits)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Brotli)
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+func TestSetEncodingEnabled(t *testing.T) {
+	const requests = 100
+	content := benchmarkText(1024)
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(content)
+	}))
+	s, ok := h.(EncodingSwitch)
+	if !ok {
+		t.Fatal("handler does not implement EncodingSwitch")
+	}
+
+	serve := func() (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "br, gzip;q=0.5")
+		rec := httptest.NewRecorder()
+
+		h.ServeHTTP(rec, req)
+
+		enc := rec.Header().Get("Content-Encoding")
+		if enc != "br" && enc != "gzip" {
+			return nil, fmt.Errorf("unexpected Content-Encoding: %#v", enc)
+		}
+		body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(body, content) {
+			return nil, fmt.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+		}
+		return rec, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < requests; i++ {
+			s.SetEncodingEnabled(Brotli, i%2 == 1)
+		}
+	}()
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := serve(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		s.SetEncodingEnabled(Brotli, enabled)
+
+		rec, err := serve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "gzip"
+		if enabled {
+			want = "br"
+		}
+		if enc := rec.Header().Get("Content-Encoding"); enc != want {
+			t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, want)
+		}
+	}
+}
+
+var uncompressedSiblingTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+	body            string
+	next            bool
+}{
+	"sibling": {
+		path:            "/file.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		body:            "sibling content",
+		next:            false,
+	},
+	"no sibling": {
+		path:            "/other.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+		body:            "decoded content",
+		next:            true,
+	},
+	"accepted": {
+		path:            "/file.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+		body:            "decoded content",
+		next:            true,
+	},
+}
+
+func TestPreferUncompressedSibling(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("decoded content"))
+	gw.Close()
+
+	fsys := http.FS(fstest.MapFS{
+		"file.txt":     &fstest.MapFile{Data: []byte("sibling content")},
+		"file.txt.gz":  &fstest.MapFile{Data: buf.Bytes()},
+		"other.txt.gz": &fstest.MapFile{Data: buf.Bytes()},
+	})
+
+	for name, tt := range uncompressedSiblingTests {
+		t.Run(name, func(t *testing.T) {
+			var next bool
+			fileServer := http.FileServer(fsys)
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next = true
+				fileServer.ServeHTTP(w, r)
+			}), PreferUncompressedSibling(fsys))
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusOK)
+			}
+			if next != tt.next {
+				t.Errorf("next handler is called: got %v, want %v", next, tt.next)
+			}
+			if typ := rec.Header().Get("Content-Type"); typ != "text/plain; charset=utf-8" {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, "text/plain; charset=utf-8")
+			}
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body is not match: got %#v, want %#v", string(body), tt.body)
+			}
+		})
+	}
+}
+
+var debugHeadersTests = map[string]struct {
+	path           string
+	acceptEncoding string
+	options        []Option
+	mode           string
+}{
+	"precompressed": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "gzip",
+		options:        []Option{DebugHeaders()},
+		mode:           "precompressed",
+	},
+	"encoded": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		options:        []Option{DebugHeaders()},
+		mode:           "encoded",
+	},
+	"decoded": {
+		path:           "/test1.txt.gz",
+		acceptEncoding: "",
+		options:        []Option{DebugHeaders()},
+		mode:           "decoded",
+	},
+	"passthrough": {
+		path:           "/test3.txt",
+		acceptEncoding: "",
+		options:        []Option{DebugHeaders()},
+		mode:           "passthrough",
+	},
+	"passthrough by skip": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		options:        []Option{DebugHeaders(), SkipContentTypes("text/plain")},
+		mode:           "passthrough",
+	},
+	"off by default": {
+		path:           "/test3.txt",
+		acceptEncoding: "gzip",
+		mode:           "",
+	},
+}
+
+func TestDebugHeaders(t *testing.T) {
+	for name, tt := range debugHeadersTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.FileServer(http.Dir("./testdata")), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status code is not match: got %d, want %d", rec.Code, http.StatusOK)
+			}
+			if mode := rec.Header().Get("X-Httpenc-Mode"); mode != tt.mode {
+				t.Errorf("X-Httpenc-Mode is not match: got %#v, want %#v", mode, tt.mode)
+			}
+		})
+	}
+}
+
+func TestFlushOnNewline(t *testing.T) {
+	lines := []string{
+		`{"id": 1, "name": "first"}` + "\n",
+		`{"id": 2, "name": "second"}` + "\n",
+		`{"id": 3, "name": "third"}` + "\n",
+	}
+
+	for _, enc := range []EncodingType{Gzip, Brotli, Deflate} {
+		t.Run(string(enc), func(t *testing.T) {
+			ack := make(chan struct{})
+			server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-ndjson")
+				for _, line := range lines {
+					io.WriteString(w, line)
+					// The next line is written after the client receives the line.
+					select {
+					case <-ack:
+					case <-time.After(5 * time.Second):
+						return
+					}
+				}
+			}), FlushOnNewline(), MinSize(1024)))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", string(enc))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("http.Client.Do(): error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if ce := resp.Header.Get("Content-Encoding"); ce != string(enc) {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", ce, enc)
+			}
+			dec, err := DecodeReader(enc, resp.Body)
+			if err != nil {
+				t.Fatalf("DecodeReader(): error: %v", err)
+			}
+			defer dec.Close()
+
+			br := bufio.NewReader(dec)
+			for _, want := range lines {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("bufio.Reader.ReadString(): error: %v", err)
+				}
+				if line != want {
+					t.Fatalf("line is not match: got %#v, want %#v", line, want)
+				}
+				select {
+				case ack <- struct{}{}:
+				case <-time.After(5 * time.Second):
+					t.Fatal("the line is not delivered promptly")
+				}
+			}
+		})
+	}
+}
+
+var maxBytesTests = map[string]struct {
+	body            string
+	options         []Option
+	statusCode      int
+	contentEncoding string
+	responseBody    string
+}{
+	"within limit": {
+		body:            "small",
+		statusCode:      http.StatusOK,
+		contentEncoding: "gzip",
+		responseBody:    "small",
+	},
+	"too large": {
+		body:            strings.Repeat("large", 10),
+		statusCode:      http.StatusRequestEntityTooLarge,
+		contentEncoding: "gzip",
+		responseBody:    "Request Entity Too Large\n",
+	},
+	"too large not compressed": {
+		body:            strings.Repeat("large", 10),
+		options:         []Option{CompressStatuses(http.StatusOK)},
+		statusCode:      http.StatusRequestEntityTooLarge,
+		contentEncoding: "",
+		responseBody:    "Request Entity Too Large\n",
+	},
+}
+
+func TestMaxBytesHandler(t *testing.T) {
+	for name, tt := range maxBytesTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.MaxBytesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					// The request body is larger than the limit.
+					http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(b)
+			}), 10), tt.options...)
+
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.statusCode {
+				t.Fatalf("status code is not match: got %d, want %d", rec.Code, tt.statusCode)
+			}
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if cl := rec.Header().Get("Content-Length"); enc != "" && cl != "" {
+				t.Errorf("Content-Length must be removed: got %#v", cl)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if string(body) != tt.responseBody {
+				t.Errorf("body is not match: got %#v, want %#v", string(body), tt.responseBody)
+			}
+		})
+	}
+}
+
+func TestEncoderMemoryLimit(t *testing.T) {
+	const (
+		limit    = 2
+		requests = 5
+	)
+
+	options := &handlerOptions{gzipLevel: gzip.DefaultCompression, brotliLevel: brotli.BestCompression}
+	// The budget is enough for limit brotli encoders and the rest of gzip encoders.
+	budget := options.encoderMemory(Brotli)*limit + options.encoderMemory(Gzip)*(requests-limit)
+
+	started := make(chan struct{}, requests+1)
+	release := make(chan struct{})
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+		started <- struct{}{}
+		<-release
+	}), BrotliLevel(brotli.BestCompression), EncoderMemoryLimit(int(budget)))
+
+	serve := func(rec *httptest.ResponseRecorder, acceptEncoding string) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		h.ServeHTTP(rec, req)
+	}
+
+	recs := make([]*httptest.ResponseRecorder, requests)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			serve(rec, "br, gzip")
+		}(recs[i])
+	}
+	for range recs {
+		<-started
+	}
+
+	close(release)
+	wg.Wait()
+
+	counts := map[string]int{}
+	for _, rec := range recs {
+		enc := rec.Header().Get("Content-Encoding")
+		counts[enc]++
+		body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+		if err != nil {
+			t.Fatalf("decodeBody(): %v", err)
+		}
+		if string(body) != "content" {
+			t.Errorf("response body is not match: got %#v, want %#v", string(body), "content")
+		}
+	}
+	// The budget caps the brotli encoders, and the rest are downshifted to gzip.
+	want := map[string]int{"br": limit, "gzip": requests - limit}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("number of encoded responses is not match: got %v, want %v", counts, want)
+	}
+
+	// The budget is released after the responses.
+	rec := httptest.NewRecorder()
+	serve(rec, "br, gzip")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "br" {
+		t.Errorf("Content-Encoding is not match: got %#v, want %#v", enc, "br")
+	}
+}
+
+func TestEncoderMemoryLimitInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("EncoderMemoryLimit(): must panic with an invalid limit")
+		}
+	}()
+
+	newHandler(http.NotFoundHandler(), true, []Option{EncoderMemoryLimit(0)})
+}
+
+var parentEncodingTests = map[string]struct {
+	parentEncoding  string
+	contentEncoding string
+}{
+	"br": {
+		parentEncoding:  "br",
+		contentEncoding: "br",
+	},
+	"alias": {
+		parentEncoding:  "x-gzip",
+		contentEncoding: "gzip",
+	},
+	"unsupported": {
+		parentEncoding:  "compress",
+		contentEncoding: "compress",
+	},
+}
+
+func TestParentEncoding(t *testing.T) {
+	content := benchmarkText(1024)
+
+	for name, tt := range parentEncodingTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}))
+			parent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", tt.parentEncoding)
+				h.ServeHTTP(w, r)
+			})
+
+			// The client prefers deflate, but the encoding chosen by the parent is used.
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "deflate, gzip;q=0.5, br;q=0.5")
+			rec := httptest.NewRecorder()
+
+			parent.ServeHTTP(rec, req)
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			if enc == "compress" {
+				// The content is not encoded by the handler.
+				enc = ""
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var multipleWriteHeaderTests = map[string]struct {
+	path            string
+	acceptEncoding  string
+	contentEncoding string
+}{
+	"encode": {
+		path:            "/test.txt",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+	},
+	"not encoded": {
+		path:            "/test.txt",
+		acceptEncoding:  "",
+		contentEncoding: "",
+	},
+	"precompression": {
+		path:            "/test.txt.gz",
+		acceptEncoding:  "gzip",
+		contentEncoding: "gzip",
+	},
+	"decode": {
+		path:            "/test.txt.gz",
+		acceptEncoding:  "",
+		contentEncoding: "",
+	},
+}
+
+func TestMultipleWriteHeader(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte("Test data"))
+	gw.Close()
+	compressed := buf.Bytes()
+
+	for name, tt := range multipleWriteHeaderTests {
+		t.Run(name, func(t *testing.T) {
+			var logBuf bytes.Buffer
+			server := httptest.NewUnstartedServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusCreated)
+				w.WriteHeader(http.StatusInternalServerError)
+				if strings.HasSuffix(r.URL.Path, ".gz") {
+					w.Write(compressed)
+				} else {
+					w.Write([]byte("Test data"))
+				}
+			})))
+			server.Config.ErrorLog = log.New(&logBuf, "", 0)
+			server.Start()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("http.Client.Do(): error: %v", err)
+			}
+			b, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("io.ReadAll(): error: %v", err)
+			}
+			server.Close()
+
+			// The status from the first call wins, as net/http does.
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("status code is not match: got %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+			enc := resp.Header.Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			body, err := decodeBody(b, EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if string(body) != "Test data" {
+				t.Errorf("body is not match: got %#v, want %#v", string(body), "Test data")
+			}
+			// The superfluous call is logged by net/http.
+			if !strings.Contains(logBuf.String(), "superfluous response.WriteHeader call") {
+				t.Errorf("superfluous call is not logged: %#v", logBuf.String())
+			}
+		})
+	}
+}
+
+var sniffBeforeEncodeTests = map[string]struct {
+	options     []Option
+	contentType string
+}{
+	"sniff before encode": {
+		options:     []Option{SniffBeforeEncode()},
+		contentType: "text/html; charset=utf-8",
+	},
+	"first write": {
+		options:     nil,
+		contentType: "text/plain; charset=utf-8",
+	},
+}
+
+func TestSniffBeforeEncode(t *testing.T) {
+	chunks := []string{"<", "!DOCTYPE html>", "<html><body>", strings.Repeat("<p>content</p>", 100), "</body></html>"}
+
+	for name, tt := range sniffBeforeEncodeTests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// The HTML is written in small chunks without Content-Type.
+				for _, chunk := range chunks {
+					io.WriteString(w, chunk)
+				}
+			}), tt.options...))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("http.Client.Do(): error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if typ := resp.Header.Get("Content-Type"); typ != tt.contentType {
+				t.Errorf("Content-Type is not match: got %#v, want %#v", typ, tt.contentType)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+			}
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll(): error: %v", err)
+			}
+			body, err := decodeBody(b, Gzip)
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if want := strings.Join(chunks, ""); string(body) != want {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(want))
+			}
+		})
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	content := benchmarkText(4096)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var errs []error
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 0; i < 10; i++ {
+			if i == 5 {
+				// The client disconnects mid-stream.
+				cancel()
+			}
+			if _, err := w.Write(content); err != nil {
+				errs = append(errs, err)
+				return
+			}
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if len(errs) != 1 {
+		t.Fatalf("Write() must fail once after cancel: got %v", errs)
+	}
+	if !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Write() error is not match: got %v, want %v", errs[0], context.Canceled)
+	}
+	var encodeErr *EncodeError
+	if !errors.As(errs[0], &encodeErr) {
+		t.Errorf("Write() error is not *EncodeError: %v", errs[0])
+	}
+}
+
+var bufferedContentLengthTests = map[string]struct {
+	contentType string
+	options     []Option
+	buffered    bool
+}{
+	"buffered for sniffing": {
+		contentType: "",
+		options:     []Option{SniffBeforeEncode()},
+		buffered:    true,
+	},
+	"streamed": {
+		contentType: "text/plain",
+		options:     nil,
+		buffered:    false,
+	},
+}
+
+func TestBufferedContentLength(t *testing.T) {
+	content := []byte(strings.Repeat("<p>small content</p>", 10))
+
+	for name, tt := range bufferedContentLengthTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.Write(content)
+			}), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, "gzip")
+			}
+			want := ""
+			if tt.buffered {
+				want = strconv.Itoa(rec.Body.Len())
+			}
+			if cl := rec.Header().Get("Content-Length"); cl != want {
+				t.Errorf("Content-Length is not match: got %#v, want %#v", cl, want)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), Gzip)
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+var bufferResponseTests = map[string]struct {
+	options         []Option
+	contentEncoding string
+	// buffered is true if the whole content is held and sent with the Content-Length header.
+	buffered bool
+}{
+	"under limit": {
+		options:         []Option{BufferResponse(4096)},
+		contentEncoding: "gzip",
+		buffered:        true,
+	},
+	"over limit": {
+		options:         []Option{BufferResponse(512)},
+		contentEncoding: "gzip",
+		buffered:        false,
+	},
+	"under min size": {
+		options:         []Option{BufferResponse(4096), MinSize(2048)},
+		contentEncoding: "",
+		buffered:        false,
+	},
+}
+
+func TestBufferResponse(t *testing.T) {
+	content := benchmarkText(1000)
+
+	for name, tt := range bufferResponseTests {
+		t.Run(name, func(t *testing.T) {
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				writeChunks(w, content, 100)
+			}), tt.options...)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			enc := rec.Header().Get("Content-Encoding")
+			if enc != tt.contentEncoding {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", enc, tt.contentEncoding)
+			}
+			want := ""
+			if tt.buffered {
+				want = strconv.Itoa(rec.Body.Len())
+			}
+			if cl := rec.Header().Get("Content-Length"); cl != want {
+				t.Errorf("Content-Length is not match: got %#v, want %#v", cl, want)
+			}
+			body, err := decodeBody(rec.Body.Bytes(), EncodingType(enc))
+			if err != nil {
+				t.Fatalf("decodeBody(): error: %v", err)
+			}
+			if !bytes.Equal(body, content) {
+				t.Errorf("body is not match: got %d bytes, want %d bytes", len(body), len(content))
+			}
+		})
+	}
+}
+
+func TestBufferResponseInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("BufferResponse(): must panic with an invalid size")
+		}
+	}()
+
+	newHandler(http.NotFoundHandler(), true, []Option{BufferResponse(0)})
+}
+
+var stableSelectionTests = map[string]struct {
+	acceptEncoding string
+	// encodings are the encodings chosen for the buckets 0, 1 and 2.
+	encodings []string
+}{
+	"same quality": {
+		acceptEncoding: "gzip, br, deflate",
+		encodings:      []string{"gzip", "br", "deflate"},
+	},
+	"partially same quality": {
+		acceptEncoding: "gzip, deflate, br;q=0.5",
+		encodings:      []string{"gzip", "deflate", "gzip"},
+	},
+	"highest quality": {
+		acceptEncoding: "gzip, br;q=0.5, deflate;q=0.1",
+		encodings:      []string{"gzip", "gzip", "gzip"},
+	},
+}
+
+func TestStableSelection(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "Test content")
+	}), StableSelection(func(r *http.Request) uint64 {
+		c, err := r.Cookie("bucket")
+		if err != nil {
+			return 0
+		}
+		n, _ := strconv.ParseUint(c.Value, 10, 64)
+		return n
+	}))
+
+	for name, tt := range stableSelectionTests {
+		t.Run(name, func(t *testing.T) {
+			for bucket, want := range tt.encodings {
+				// The same bucket always gets the same encoding.
+				for i := 0; i < 3; i++ {
+					req := httptest.NewRequest(http.MethodGet, "/", nil)
+					req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+					req.AddCookie(&http.Cookie{Name: "bucket", Value: strconv.Itoa(bucket)})
+					rec := httptest.NewRecorder()
+
+					h.ServeHTTP(rec, req)
+
+					if enc := rec.Header().Get("Content-Encoding"); enc != want {
+						t.Fatalf("bucket %d: Content-Encoding is not match: got %#v, want %#v", bucket, enc, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMultipartStreaming(t *testing.T) {
+	parts := []string{"first part", "second part", "third part"}
+
+	for _, enc := range []EncodingType{Gzip, Deflate, Brotli} {
+		t.Run(string(enc), func(t *testing.T) {
+			read := make(chan struct{})
+			server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mw := multipart.NewWriter(w)
+				w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mw.Boundary())
+
+				for i, part := range parts {
+					pw, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain"}})
+					if err != nil {
+						t.Errorf("multipart.Writer.CreatePart(): error: %v", err)
+						return
+					}
+					io.WriteString(pw, part)
+					w.(http.Flusher).Flush()
+
+					// The next part is written after the client has read the flushed part.
+					select {
+					case <-read:
+					case <-time.After(5 * time.Second):
+						t.Errorf("part %d is not delivered", i)
+						return
+					}
+				}
+				mw.Close()
+			})))
+			defer server.Close()
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): error: %v", err)
+			}
+			req.Header.Set("Accept-Encoding", string(enc))
+			client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Get: error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if got := resp.Header.Get("Content-Encoding"); got != string(enc) {
+				t.Fatalf("Content-Encoding is not match: got %#v, want %#v", got, enc)
+			}
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil {
+				t.Fatalf("mime.ParseMediaType(): error: %v", err)
+			}
+
+			r, err := newDecodeReader(resp.Body, enc)
+			if err != nil {
+				t.Fatalf("newDecodeReader(): error: %v", err)
+			}
+			mr := multipart.NewReader(r, params["boundary"])
+			for i, want := range parts {
+				p, err := mr.NextPart()
+				if err != nil {
+					t.Fatalf("part %d: multipart.Reader.NextPart(): error: %v", i, err)
+				}
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(p, got); err != nil {
+					t.Fatalf("part %d: io.ReadFull(): error: %v", i, err)
+				}
+				if string(got) != want {
+					t.Errorf("part %d is not match: got %#v, want %#v", i, string(got), want)
+				}
+				read <- struct{}{}
+			}
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Errorf("multipart.Reader.NextPart(): error is not io.EOF: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package httpenc
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The total number of bytes of the content encoded by handlers, before and after encoding.
+var (
+	statsIn  int64
+	statsOut int64
+)
+
+// Stats returns the total number of bytes of the content encoded by all handlers
+// in the process, before and after encoding.
+// The content that is not encoded, such as precompression content, is not counted.
+func Stats() (in, out int64) {
+	return atomic.LoadInt64(&statsIn), atomic.LoadInt64(&statsOut)
+}
+
+// ResetStats resets the total number of bytes returned by Stats to zero,
+// such as after a deploy. It is safe to call while handlers are encoding responses,
+// but the bytes of a response finished during the call may be counted before or after it,
+// and in and out are not reset at once.
+func ResetStats() {
+	atomic.StoreInt64(&statsIn, 0)
+	atomic.StoreInt64(&statsOut, 0)
+}
+
+// addStats adds the number of bytes of an encoded content to the total.
+func addStats(in, out int64) {
+	atomic.AddInt64(&statsIn, in)
+	atomic.AddInt64(&statsOut, out)
+}
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// EncodeInfo describes a response encoded by the handler.
+type EncodeInfo struct {
+	// Request is the request of the response.
+	Request *http.Request
+	// Encoding is the encoding of the response.
+	Encoding EncodingType
+	// InputBytes and OutputBytes are the sizes of the content before and after encoding.
+	InputBytes  int64
+	OutputBytes int64
+	// SizeBucket is the size class of InputBytes, one of the SizeBucket constants.
+	SizeBucket string
+}
+
+// Size classes of the content set to EncodeInfo.
+const (
+	SizeBucketTiny   = "<1KiB"
+	SizeBucketSmall  = "1KiB-10KiB"
+	SizeBucketMedium = "10KiB-100KiB"
+	SizeBucketLarge  = "100KiB-1MiB"
+	SizeBucketHuge   = ">=1MiB"
+)
+
+// sizeBucket returns the size class of size bytes.
+func sizeBucket(size int64) string {
+	switch {
+	case size < 1<<10:
+		return SizeBucketTiny
+	case size < 10<<10:
+		return SizeBucketSmall
+	case size < 100<<10:
+		return SizeBucketMedium
+	case size < 1<<20:
+		return SizeBucketLarge
+	default:
+		return SizeBucketHuge
+	}
+}
+
+// OnEncode returns an Option that sets the function called with EncodeInfo
+// whenever a response is encoded. It is useful for telemetry.
+func OnEncode(f func(info EncodeInfo)) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.onEncode = f
+	})
+}
+
+// A MetricsSink receives the metrics of responses encoded by the handler.
+// It can be adapted to a metrics backend, such as Prometheus.
+type MetricsSink interface {
+	// ObserveCompression is called whenever a response is encoded with enc.
+	// in and out are the number of bytes before and after encoding,
+	// and dur is the duration from the creation of the encoder to its close.
+	ObserveCompression(enc string, in, out int64, dur time.Duration)
+}
+
+// WithMetrics returns an Option that sets the MetricsSink receiving the metrics of encoded responses.
+func WithMetrics(sink MetricsSink) Option {
+	return optionFunc(func(opts *handlerOptions) {
+		opts.metrics = sink
+	})
+}
@@ -0,0 +1,229 @@
+package httpenc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	const requests = 50
+	content := benchmarkText(8192)
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(content)
+	}))
+
+	in0, out0 := Stats()
+
+	var wg sync.WaitGroup
+	sizes := make([]int, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if i%2 == 0 {
+				req.Header.Set("Accept-Encoding", "gzip")
+			} else {
+				req.Header.Set("Accept-Encoding", "br")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			sizes[i] = rec.Body.Len()
+		}(i)
+	}
+	wg.Wait()
+
+	var wantOut int64
+	for _, size := range sizes {
+		wantOut += int64(size)
+	}
+	wantIn := int64(requests * len(content))
+
+	in, out := Stats()
+	if in-in0 != wantIn {
+		t.Errorf("in is not match: got %d, want %d", in-in0, wantIn)
+	}
+	if out-out0 != wantOut {
+		t.Errorf("out is not match: got %d, want %d", out-out0, wantOut)
+	}
+	if wantOut >= wantIn {
+		t.Errorf("content is not compressed: in %d, out %d", wantIn, wantOut)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(benchmarkText(8192))
+	}))
+	serve := func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve()
+	if in, out := Stats(); in == 0 || out == 0 {
+		t.Fatalf("Stats() is not counted: in %d, out %d", in, out)
+	}
+
+	ResetStats()
+	if in, out := Stats(); in != 0 || out != 0 {
+		t.Errorf("Stats() is not reset: in %d, out %d", in, out)
+	}
+
+	// It is safe to reset while responses are encoded.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			serve()
+		}()
+		go func() {
+			defer wg.Done()
+			ResetStats()
+		}()
+	}
+	wg.Wait()
+
+	ResetStats()
+	if in, out := Stats(); in != 0 || out != 0 {
+		t.Errorf("Stats() is not reset: in %d, out %d", in, out)
+	}
+}
+
+var sizeBucketTests = map[string]struct {
+	size   int
+	bucket string
+}{
+	"tiny":   {size: 100, bucket: SizeBucketTiny},
+	"small":  {size: 1024, bucket: SizeBucketSmall},
+	"medium": {size: 50 * 1024, bucket: SizeBucketMedium},
+	"large":  {size: 100 * 1024, bucket: SizeBucketLarge},
+	"huge":   {size: 2 * 1024 * 1024, bucket: SizeBucketHuge},
+}
+
+func TestOnEncode(t *testing.T) {
+	for name, tt := range sizeBucketTests {
+		t.Run(name, func(t *testing.T) {
+			content := benchmarkText(tt.size)
+
+			var infos []EncodeInfo
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}), OnEncode(func(info EncodeInfo) {
+				infos = append(infos, info)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if len(infos) != 1 {
+				t.Fatalf("OnEncode(): function is called %d times, want once", len(infos))
+			}
+			info := infos[0]
+			if info.Request == nil || info.Request.URL.Path != "/" {
+				t.Errorf("Request is not match: got %v", info.Request)
+			}
+			if info.Encoding != Gzip {
+				t.Errorf("Encoding is not match: got %#v, want %#v", info.Encoding, Gzip)
+			}
+			if info.InputBytes != int64(len(content)) {
+				t.Errorf("InputBytes is not match: got %d, want %d", info.InputBytes, len(content))
+			}
+			if info.OutputBytes != int64(rec.Body.Len()) {
+				t.Errorf("OutputBytes is not match: got %d, want %d", info.OutputBytes, rec.Body.Len())
+			}
+			if info.SizeBucket != tt.bucket {
+				t.Errorf("SizeBucket is not match: got %#v, want %#v", info.SizeBucket, tt.bucket)
+			}
+		})
+	}
+}
+
+type observation struct {
+	enc     string
+	in, out int64
+	dur     time.Duration
+}
+
+// fakeSink is a MetricsSink that records the observations.
+type fakeSink struct {
+	observations []observation
+}
+
+func (s *fakeSink) ObserveCompression(enc string, in, out int64, dur time.Duration) {
+	s.observations = append(s.observations, observation{enc: enc, in: in, out: out, dur: dur})
+}
+
+var metricsTests = map[string]struct {
+	acceptEncoding string
+	observed       bool
+}{
+	"gzip": {
+		acceptEncoding: "gzip",
+		observed:       true,
+	},
+	"br": {
+		acceptEncoding: "br",
+		observed:       true,
+	},
+	"not encoded": {
+		acceptEncoding: "",
+		observed:       false,
+	},
+}
+
+func TestWithMetrics(t *testing.T) {
+	content := benchmarkText(8192)
+
+	for name, tt := range metricsTests {
+		t.Run(name, func(t *testing.T) {
+			sink := &fakeSink{}
+			h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write(content)
+			}), WithMetrics(sink))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+
+			h.ServeHTTP(rec, req)
+
+			if !tt.observed {
+				if len(sink.observations) != 0 {
+					t.Errorf("observations is not empty: got %#v", sink.observations)
+				}
+				return
+			}
+			if len(sink.observations) != 1 {
+				t.Fatalf("number of observations is not match: got %d, want %d", len(sink.observations), 1)
+			}
+			o := sink.observations[0]
+			if o.enc != tt.acceptEncoding {
+				t.Errorf("encoding is not match: got %#v, want %#v", o.enc, tt.acceptEncoding)
+			}
+			if o.in != int64(len(content)) {
+				t.Errorf("in is not match: got %d, want %d", o.in, len(content))
+			}
+			if o.out != int64(rec.Body.Len()) {
+				t.Errorf("out is not match: got %d, want %d", o.out, rec.Body.Len())
+			}
+			if o.dur <= 0 {
+				t.Errorf("duration is not positive: got %v", o.dur)
+			}
+		})
+	}
+}